@@ -0,0 +1,237 @@
+package main
+
+/*
+Operator overrides.
+
+For maintenance, rather than editing zone.conf, an operator can layer
+an override on top of the health checks for a target:
+
+  drain       leave the target out of answers (even if everything else
+              is down), but keep reporting its real health
+  force-up    treat every check of the target as up
+  force-down  treat every check of the target as down
+  clear       remove the override
+
+  curl -H "Authorization: Bearer $TOKEN" \
+       -d reason="disk swap" -d expires=2h \
+       http://localhost:8080/gslb/admin/target/comcast-ct.test-ipv6.com/drain
+
+"expires" is optional; either seconds, or a duration like "90m".
+GET /gslb/admin/targets lists the current overrides.
+
+The API is off unless server.conf has a token:
+
+[admin]
+token: some-long-random-string
+
+Overrides live in memory alongside the health checks, so they survive
+config reloads (but not restarts).
+*/
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Override is an operator's override of the health of a target.
+type Override struct {
+	Mode    string    `json:"mode"`    // drain, force-up, force-down
+	Reason  string    `json:"reason"`  // Free text, for /gslb/hc and traces
+	Set     time.Time `json:"set"`     // When it was put in place
+	Expires time.Time `json:"expires"` // Zero: never
+}
+
+// overrideModes are the valid values of Override.Mode.
+var overrideModes = map[string]bool{"drain": true, "force-up": true, "force-down": true}
+
+// Active returns true if the override has not yet expired.
+func (o *Override) Active() bool {
+	return o.Expires.IsZero() || time.Now().Before(o.Expires)
+}
+
+// apply returns a check status, as changed by the override (if any).
+func (o *Override) apply(status bool) bool {
+	if o == nil || !o.Active() {
+		return status
+	}
+	switch o.Mode {
+	case "force-up":
+		return true
+	case "force-down":
+		return false
+	}
+	return status
+}
+
+func (o Override) String() string {
+	s := fmt.Sprintf("%s %q", o.Mode, o.Reason)
+	if !o.Expires.IsZero() {
+		s = s + " until " + o.Expires.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// overrideKey is how a target is kept in HealthChecks.Overrides: lower case,
+// without a trailing dot or a :port; the same, however zone.conf or the
+// operator wrote it.
+func overrideKey(target string) string {
+	return strings.TrimSuffix(toLower(hcHost(target)), ".")
+}
+
+// SetOverride puts an operator override in place for a target.
+// A zero expires means it stays until cleared.
+func SetOverride(target string, mode string, reason string, expires time.Time) error {
+	if !overrideModes[mode] {
+		return fmt.Errorf("unknown override %q, wanted drain, force-up or force-down", mode)
+	}
+	o := &Override{Mode: mode, Reason: reason, Set: time.Now(), Expires: expires}
+	HealthChecks.Lock.Lock() // RW
+	HealthChecks.Overrides[overrideKey(target)] = o
+	HealthChecks.Lock.Unlock() // RW
+	if !expires.IsZero() {
+		time.AfterFunc(time.Until(expires), func() {
+			ClearCaches("operator override expired for " + target)
+			notifyTargetPools(target)
+		})
+	}
+	ClearCaches(fmt.Sprintf("operator override for %s: %v", target, o))
+	notifyTargetPools(target)
+	return nil
+}
+
+// ClearOverride removes any operator override for a target.
+// Returns true if there was one.
+func ClearOverride(target string) bool {
+	HealthChecks.Lock.Lock() // RW
+	_, found := HealthChecks.Overrides[overrideKey(target)]
+	delete(HealthChecks.Overrides, overrideKey(target))
+	HealthChecks.Lock.Unlock() // RW
+	if found {
+		ClearCaches("operator override cleared for " + target)
+		notifyTargetPools(target)
+	}
+	return found
+}
+
+// GetOverride returns the active operator override (if any) for a target.
+// Use only if "ok".
+func GetOverride(target string) (o Override, ok bool) {
+	HealthChecks.Lock.RLock() // RO
+	found := HealthChecks.Overrides[overrideKey(target)]
+	HealthChecks.Lock.RUnlock() // RO
+	if found == nil || !found.Active() {
+		return o, false
+	}
+	return *found, true
+}
+
+// Drained returns true if an operator has drained the target.
+func Drained(target string) bool {
+	o, ok := GetOverride(target)
+	return ok && o.Mode == "drain"
+}
+
+// parseExpires turns "3600" or "90m" into an expiry time; "" means never.
+func parseExpires(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Now().Add(time.Duration(secs) * time.Second), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad expires %q: %v", s, err)
+	}
+	return time.Now().Add(d), nil
+}
+
+// adminAuthorized checks the caller's bearer token against [admin] token.
+// With no token configured, nobody is authorized.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	return tokenAuthorized(w, r, "admin")
+}
+
+// tokenAuthorized checks the caller's bearer token against "token" in a server.conf section.
+func tokenAuthorized(w http.ResponseWriter, r *http.Request, section string) bool {
+	token, ok := GlobalConfig().GetSectionNameValueString(section, "token")
+	if !ok || token == "" {
+		http.Error(w, fmt.Sprintf("%s API disabled; set [%s] token in server.conf", section, section), http.StatusForbidden)
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// myHTTPAdminTargetHandler serves POST /gslb/admin/target/NAME/ACTION
+func myHTTPAdminTargetHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	words := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/gslb/admin/target/"), "/"), "/")
+	if len(words) != 2 || words[0] == "" {
+		http.Error(w, "wanted /gslb/admin/target/NAME/ACTION", http.StatusBadRequest)
+		return
+	}
+	target, action := toLower(words[0]), words[1]
+
+	w.Header().Set("Content-Type", "text/plain")
+	if action == "clear" {
+		if ClearOverride(target) {
+			io.WriteString(w, fmt.Sprintf("%s: override cleared\n", target))
+		} else {
+			io.WriteString(w, fmt.Sprintf("%s: no override\n", target))
+		}
+		return
+	}
+	expires, err := parseExpires(r.FormValue("expires"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := SetOverride(target, action, r.FormValue("reason"), expires); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	o, _ := GetOverride(target)
+	io.WriteString(w, fmt.Sprintf("%s: %v\n", target, o))
+}
+
+// myHTTPAdminTargetsHandler serves GET /gslb/admin/targets
+func myHTTPAdminTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	ret := []string{}
+	HealthChecks.Lock.RLock() // RO
+	for target, o := range HealthChecks.Overrides {
+		if o.Active() {
+			ret = append(ret, fmt.Sprintf("%s: %v\n", target, *o))
+		}
+	}
+	HealthChecks.Lock.RUnlock() // RO
+	sort.Strings(ret)
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, strings.Join(ret, ""))
+}
+
+func init() {
+	http.HandleFunc("/gslb/admin/target/", myHTTPAdminTargetHandler)
+	http.HandleFunc("/gslb/admin/targets", myHTTPAdminTargetsHandler)
+}
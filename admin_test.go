@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(method string, path string, token string, form string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	myHTTPAdminTargetHandler(w, r)
+	return w
+}
+
+func TestAdminTargetHandler(t *testing.T) {
+	initGlobal("t/etc")
+	defer ClearOverride("two.example.com")
+
+	var tests = []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"POST", "/gslb/admin/target/two.example.com/drain", "", http.StatusUnauthorized},
+		{"POST", "/gslb/admin/target/two.example.com/drain", "wrong", http.StatusUnauthorized},
+		{"GET", "/gslb/admin/target/two.example.com/drain", "unit-test-token", http.StatusMethodNotAllowed},
+		{"POST", "/gslb/admin/target/two.example.com/explode", "unit-test-token", http.StatusBadRequest},
+		{"POST", "/gslb/admin/target/two.example.com", "unit-test-token", http.StatusBadRequest},
+		{"POST", "/gslb/admin/target/two.example.com/drain", "unit-test-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := adminRequest(tt.method, tt.path, tt.token, "reason=unit+test")
+		if w.Code != tt.code {
+			t.Errorf("%s %s (token %q) returned %v, wanted %v: %s", tt.method, tt.path, tt.token, w.Code, tt.code, w.Body.String())
+		}
+	}
+	if o, ok := GetOverride("two.example.com"); !ok || o.Mode != "drain" || o.Reason != "unit test" {
+		t.Errorf("GetOverride(two.example.com) after drain, found %v %v", o, ok)
+	}
+	if w := adminRequest("POST", "/gslb/admin/target/two.example.com/clear", "unit-test-token", ""); w.Code != http.StatusOK {
+		t.Errorf("clear returned %v", w.Code)
+	}
+	if _, ok := GetOverride("two.example.com"); ok {
+		t.Errorf("GetOverride(two.example.com) still set after clear")
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	initGlobal("t/etc")
+	zoneRef := GlobalZoneData()
+	notrace := NewLookupTraceOff()
+	AddCheck("check_true", "admin.example.com", 3600)
+	waitForPoll("check_true", "admin.example.com")
+	waitForPoll("check_true", "one.example.com")
+	waitForPoll("check_true", "two.example.com")
+	defer ClearOverride("admin.example.com")
+	defer ClearOverride("one.example.com")
+	defer ClearOverride("two.example.com")
+
+	SetOverride("admin.example.com", "force-down", "unit test", time.Time{})
+	if status, _ := GetStatus("check_true", "admin.example.com"); status != false {
+		t.Errorf("GetStatus() with force-down, found %v", status)
+	}
+	if !strings.Contains(dumpHealthCheckStatusAsText(), `check_true admin.example.com: false`) {
+		t.Errorf("/gslb/hc does not show the override")
+	}
+	SetOverride("admin.example.com", "force-up", "unit test", time.Now().Add(-time.Second)) // Already expired
+	if status, _ := GetStatus("check_true", "admin.example.com"); status != true {
+		t.Errorf("GetStatus() with an expired override, found %v", status)
+	}
+
+	// Drained targets leave the answers, even if that leaves nothing.
+	SetOverride("one.example.com", "drain", "unit test", time.Time{})
+	found := fmt.Sprintf("%v", LookupBackEnd("drain.example.com", "default", false, zoneRef, 0, notrace))
+	if found != "[A 192.0.2.2]" {
+		t.Errorf("LookupBackEnd(drain.example.com) with one drained, found %v", found)
+	}
+	found = fmt.Sprintf("%v", LookupBackEnd("drainexpand.example.com", "default", false, zoneRef, 0, notrace))
+	if found != "[A 192.0.2.2]" {
+		t.Errorf("LookupBackEnd(drainexpand.example.com) with one drained, found %v", found)
+	}
+	SetOverride("TWO.example.com.", "drain", "unit test", time.Time{}) // However it is written
+	found = fmt.Sprintf("%v", LookupBackEnd("drain.example.com", "default", false, zoneRef, 0, notrace))
+	if found != "[]" {
+		t.Errorf("LookupBackEnd(drain.example.com) with both drained, found %v", found)
+	}
+	found = fmt.Sprintf("%v", LookupBackEnd("drainfb.example.com", "default", false, zoneRef, 0, notrace))
+	if found != "[]" {
+		t.Errorf("LookupBackEnd(drainfb.example.com) with the fallback drained, found %v", found)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+/*
+What to answer when every health checked target of a name is down
+(and there is no FB to fall back on).
+
+  rerun         answer as if there were no health checks (the default)
+  empty         an empty NOERROR answer
+  servfail      SERVFAIL
+  sorry ADDR    a "sorry" address (or name, whose A/AAAA records are used)
+
+Per name, in zone.conf:
+
+  www.example.com:
+   - HC check_http a.example.com
+   - HC check_http b.example.com
+   - ON-ALL-DOWN sorry 192.0.2.99
+
+Per view, next to its "as:" and "resolver:" lines (a policy in
+[default] covers every view without its own):
+
+[comcast]
+as: 7922
+on-all-down: servfail
+
+Only the name being answered applies a policy.  A name pulled in by
+EXPAND or FB whose targets are all down adds nothing to the name that
+pulled it in; if that leaves no addresses, that name's own policy (or its
+view's) is used.  Give aliases their own ON-ALL-DOWN when needed.
+
+The trace shows the policy used; the all_down stats count each time one
+is applied (per answer worked out, not per cached reply).
+*/
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var statsAllDown = newStat("all_down")
+
+// allDownPolicies are the valid policies, and whether they take an argument.
+var allDownPolicies = map[string]bool{"rerun": false, "empty": false, "servfail": false, "sorry": true}
+
+// allDownPolicy finds the policy for a name: its own ON-ALL-DOWN line first,
+// then its view's on-all-down.  Returns the words of the policy ("sorry", "192.0.2.99").
+func allDownPolicy(zoneRef *Config, view string, found []string) (policy []string, where string) {
+	now := time.Now()
+	for _, line := range found {
+		words, active := activeWords(line, now)
+		if active && len(words) >= 2 && toUpper(words[0]) == "ON-ALL-DOWN" {
+			return words[1:], "name"
+		}
+	}
+	if s, ok := zoneRef.GetSectionNameValueString(view, "on-all-down"); ok {
+		if words := QuotedStringToWords(s); len(words) > 0 {
+			return words, "view"
+		}
+	}
+	return []string{"rerun"}, "default"
+}
+
+// applyAllDown works out the answer for a name whose health checked targets are all down.
+// "rerun" asks the caller to look again with health checks disabled; otherwise
+// the lines returned are the answer.  Empty and servfail answers are an
+// ALLDOWN line, for LookupFrontEndNoCache.
+func applyAllDown(qname string, view string, zoneRef *Config, found []string, recursion int, trace *LookupTrace) (lines []string, rerun bool) {
+	policy, where := allDownPolicy(zoneRef, view, found)
+	how := toLower(policy[0])
+	if takesArg, ok := allDownPolicies[how]; !ok || (takesArg && len(policy) < 2) {
+		trace.Addf(recursion, "ON-ALL-DOWN %s (%s): not understood; using rerun", strings.Join(policy, " "), where)
+		policy, how = []string{"rerun"}, "rerun"
+	}
+	trace.Addf(recursion, "ON-ALL-DOWN %s (%s)", strings.Join(policy, " "), where)
+	statsAllDown.Increment(how)
+
+	switch how {
+	case "empty", "servfail":
+		return []string{"ALLDOWN " + how}, false
+	case "sorry":
+		sorry := policy[1]
+		if ip := net.ParseIP(sorry); ip != nil {
+			if ip.To4() != nil {
+				return []string{"A " + ip.String()}, false
+			}
+			return []string{"AAAA " + ip.String()}, false
+		}
+		for _, line := range LookupBackEnd(toLower(sorry), view, true, zoneRef, recursion+1, trace) {
+			if token := parseTokenFromString(line); token == "A" || token == "AAAA" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) > 0 {
+			return lines, false
+		}
+		trace.Addf(recursion, "ON-ALL-DOWN sorry %s: no addresses; using rerun", sorry)
+	}
+	return nil, true
+}
+
+// allDownResults turns an ALLDOWN line into the final answer.
+func allDownResults(zoneRef *Config, qname string, view string, line string, recursion int, trace *LookupTrace) LookupResults {
+	words := QuotedStringToWords(line)
+	if len(words) >= 2 && words[1] == "servfail" {
+		return LookupResults{Rcode: dns.RcodeServerFailure}
+	}
+	return NoAnswers(zoneRef, qname, view, recursion, trace)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestOnAllDown(t *testing.T) {
+	initGlobal("t/etc")
+	waitForPoll("check_true", "two.example.com")
+	ClearCaches("unit testing TestOnAllDown")
+
+	var tests = []struct {
+		qname string
+		view  string
+		rcode int
+		ans   string
+		trace string
+	}{
+		{"alldown-empty.example.com", "default", dns.RcodeSuccess, `[]`, "ON-ALL-DOWN empty (name)"},
+		{"alldown-sorry.example.com", "default", dns.RcodeSuccess, `[alldown-sorry.example.com. 300 A 192.0.2.99]`, "ON-ALL-DOWN sorry 192.0.2.99 (name)"},
+		{"alldown-sorryname.example.com", "default", dns.RcodeSuccess, `[alldown-sorryname.example.com. 300 A 192.0.2.1]`, "ON-ALL-DOWN sorry ds.example.com (name)"},
+		{"alldown-view.example.com", "default", dns.RcodeSuccess, `[alldown-view.example.com. 300 A 192.0.2.1]`, "ON-ALL-DOWN rerun (default)"},
+		{"alldown-view.example.com", "gigo", dns.RcodeServerFailure, `[]`, "ON-ALL-DOWN servfail (view)"},
+		{"alldown-empty.example.com", "gigo", dns.RcodeSuccess, `[]`, "ON-ALL-DOWN empty (name)"}, // The name wins
+		{"alldown-parent.example.com", "default", dns.RcodeSuccess, `[alldown-parent.example.com. 300 A 192.0.2.2]`, "leaving ON-ALL-DOWN to the name asked for"},
+		{"alldown-alias.example.com", "default", dns.RcodeSuccess, `[alldown-alias.example.com. 300 A 192.0.2.1]`, "ON-ALL-DOWN rerun (default)"}, // The name asked for decides
+	}
+	for _, tt := range tests {
+		trace := NewLookupTrace()
+		r := LookupFrontEndNoCache(tt.qname, tt.view, "A", 0, trace)
+		if found := fmt.Sprintf("%s", r.Ans); r.Rcode != tt.rcode || found != tt.ans {
+			t.Errorf("%s (%s): rcode %v answer %v, wanted rcode %v answer %v", tt.qname, tt.view, rcodeToString(r.Rcode), found, rcodeToString(tt.rcode), tt.ans)
+		}
+		if !strings.Contains(strings.Join(trace.trace, ""), tt.trace) {
+			t.Errorf("%s (%s): trace does not show %q", tt.qname, tt.view, tt.trace)
+		}
+	}
+
+	// An empty answer is still ours: NOERROR with the SOA, not NXDOMAIN.
+	if r := LookupFrontEndNoCache("alldown-empty.example.com", "default", "A", 0, NewLookupTraceOff()); len(r.Auth) == 0 || !r.Aa {
+		t.Errorf("alldown-empty.example.com: wanted an authoritative NODATA answer with the SOA, found %+v", r)
+	}
+	if n := statsAllDown.counters.Get("servfail"); n == nil || n.String() == "0" {
+		t.Errorf("all_down servfail counter did not count")
+	}
+}
@@ -37,6 +37,7 @@ type LookupBEKey struct {
 	qname  string
 	view   string
 	skipHC bool
+	nested bool
 }
 
 // QueryInfo defines the common ways we segregate the cache.
@@ -47,6 +48,9 @@ type QueryInfo struct {
 	qname string
 	view  string
 	qtype string
+	do    bool // DNSSEC OK; signed answers are cached apart
+	edns  bool // Replies to EDNS0 queries carry an OPT record
+	size  int  // Size class (edns.go); answers are packed to fit
 }
 
 // MsgCacheRecord Contains the packed binary response, and the rcode for statistics purposes
@@ -66,6 +70,10 @@ func ClearCaches(reason string) {
 	CacheQW.ClearCache()
 	CacheView.ClearCache()
 	CacheRR.ClearCache()
+	CacheMsgs.ClearCache()
+	Publish(Event{Kind: "cache", New: reason})
+	triggerWatchRoutes() // Answers may have changed
+	triggerTransfers()   // and so may zones
 }
 
 // Satisfy generator.go during editing.
@@ -101,6 +101,13 @@ func (c *CacheContainer_KEYTYPE_VALNAME) Set(k KEYTYPE, v VALTYPE) {
 	}
 }
 
+// Delete (k KEYTYPE) removes one entry from the cache, if it is there.
+func (c *CacheContainer_KEYTYPE_VALNAME) Delete(k KEYTYPE) {
+	c.Lock.Lock() // Read+Write Lock
+	delete(c.Cache, k)
+	c.Lock.Unlock()
+}
+
 func (c *CacheContainer_KEYTYPE_VALNAME) CheckConfig() {
 	if GlobalConfigAvailable() {
 		config := GlobalConfig()
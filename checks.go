@@ -7,44 +7,81 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"strings"
-	"time"
 )
 
 // Dispatch function.  Any new checks must also update this function.
-func dispatchServiceCheck(service string, target string) (b bool, e error) {
+// If addr is specified, the check is made against that one address
+// only, rather than whatever the target name resolves to.
+func dispatchServiceCheck(service string, target string, addr string) (b bool, e error) {
 	// Do stuff, once
 	defer func() {
 	  if b==false || e != nil {
-  	  log.Printf("service check service=%s target=%s bool=%v error=%v\n",service,target,b,e)
+  	  log.Printf("service check service=%s target=%s addr=%s bool=%v error=%v\n",service,target,addr,b,e)
 	  }
 	}()
 
 	switch service {
 	case "check_true":
-		return checkTrue(target)
+		return checkTrue(target, addr)
 	case "check_false":
-		return checkFalse(target)
+		return checkFalse(target, addr)
 	case "check_http":
-		return checkHTTP(target)
+		return checkHTTP(target, addr)
 	case "check_mirror":
-		return checkMirror(target)
+		return checkMirror(service, target, addr)
 	case "check_irc":
-		return checkIRC(target)
+		return checkIRC(target, addr)
+	case "check_tcp":
+		return checkTCP(service, target, addr)
+	case "check_dns":
+		return checkDNS(service, target, addr)
+	case "check_grpc":
+		return checkGRPC(service, target, addr)
+	case "passive":
+		return checkPassive(target)
+	}
 
+	// Not built in?  server.conf may define it, in a section named after the service.
+	if kind, ok := checkParam(service, "type"); ok {
+		switch kind {
+		case "tcp", "udp":
+			return checkTCP(service, target, addr)
+		case "dns":
+			return checkDNS(service, target, addr)
+		case "grpc":
+			return checkGRPC(service, target, addr)
+		case "mirror":
+			return checkMirror(service, target, addr)
+		case "exec":
+			return checkExec(service, target, addr)
+		case "composite":
+			return checkComposite(service, target)
+		}
 	}
 	log.Printf("Unexpected service name %v, fix your configs!\n", service)
 	return false, errors.New("Unexpected service name")
 }
 
-func checkTrue(url string) (bool, error) {
+func checkTrue(url string, addr string) (bool, error) {
 	return true, nil
 }
-func checkFalse(url string) (bool, error) {
+func checkFalse(url string, addr string) (bool, error) {
 	return false, nil
 }
-func checkIRC(url string) (bool, error) {
-	return checkNetworkHostPort("tcp", url+":6667")
+func checkIRC(url string, addr string) (bool, error) {
+	return checkNetworkHostPort("check_irc", "tcp", addressHostPort(url, addr, "6667"))
+}
+
+// checkPerAddress indicates if a service checks each address of a target
+// on its own.  Checks that only look at other checks, do not.
+func checkPerAddress(service string) bool {
+	if isComposite(service) {
+		return false
+	}
+	if service == "passive" {
+		return false // The agent reports for the target as a whole
+	}
+	return true
 }
 
 // LookupAddress - given a name, a view, *and* a RR type
@@ -81,6 +118,26 @@ func LookupAddressDS(qname string) (value string, ok bool) {
 	}
 	return val, ok
 }
+
+// LookupAddresses returns every A and AAAA address we know for a name,
+// in the order found in zone.conf.  Used by health checks to probe
+// each address of a target independently.
+func LookupAddresses(qname string) (addrs []string) {
+	zoneRef := GlobalZoneData()
+	notrace := NewLookupTraceOff()
+	lookup := LookupBackEnd(qname, "default", true, zoneRef, 2, notrace) // Dummy recursion=2
+	for _, line := range lookup {
+		words := QuotedStringToWords(line)
+		token := toUpper(words[0])
+		if (token == "A" || token == "AAAA") && len(words) >= 2 {
+			addrs = append(addrs, words[len(words)-1])
+		}
+	}
+	return addrs
+}
+
+// LookupAddressHostPort finds the address (and port) to use for a name.
+// The first AAAA is preferred, then the first A.
 func LookupAddressHostPort(qname string, port string) (hostport string, ok bool) {
 
 	// First: See if they specified host:port already; capture port
@@ -109,10 +166,39 @@ func LookupAddressHostPort(qname string, port string) (hostport string, ok bool)
 	return net.JoinHostPort(qname, port), false
 }
 
-func checkNetworkHostPort(proto string, hostport string) (bool, error) {
-	seconds := 10
-	timeout := time.Duration(seconds) * time.Second
-	c, err := net.DialTimeout(proto, hostport, timeout)
+// addressHostPort is LookupAddressHostPort, except that if a specific
+// address was given to us, we use that instead of looking one up.
+// A port given as part of host (host:port) wins over the default.
+func addressHostPort(host string, addr string, port string) string {
+	if addr == "" {
+		hostport, _ := LookupAddressHostPort(host, port) // Find IP - either internally, or DNS
+		return hostport
+	}
+	if _, p, err := net.SplitHostPort(host); err == nil {
+		port = p
+	}
+	return net.JoinHostPort(addr, port)
+}
+
+// sameFamilyAddress picks an address for name with the same
+// address family as addr.  Returns "" if there is none, or if addr
+// was not specified; the caller should then fall back to the default.
+func sameFamilyAddress(name string, addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	wantV4 := ip.To4() != nil
+	for _, a := range LookupAddresses(name) {
+		if ip2 := net.ParseIP(a); ip2 != nil && (ip2.To4() != nil) == wantV4 {
+			return a
+		}
+	}
+	return ""
+}
+
+func checkNetworkHostPort(service string, proto string, hostport string) (bool, error) {
+	c, err := checkDialTimeout(service, proto, hostport)
 	if err != nil {
 		return false, err
 	}
@@ -121,18 +207,15 @@ func checkNetworkHostPort(proto string, hostport string) (bool, error) {
 }
 
 // check_http will always do port 80.
-func checkHTTP(host string) (bool, error) {
-	// Allow up to 10 seconds to try this out.
-	return checkHTTPHelper(host, "80")
+func checkHTTP(host string, addr string) (bool, error) {
+	return checkHTTPHelper("check_http", host, addr, "80")
 }
 
 // checkHTTPHelper will check any port, not just 80.
-func checkHTTPHelper(host string, port string) (bool, error) {
-	// Allow up to 10 seconds to try this out.
-	seconds := 10
-	timeout := time.Duration(seconds) * time.Second
-	client := &http.Client{Timeout: timeout}
-	hostport, _ := LookupAddressHostPort(host, port) // Find IP - either internally, or DNS
+// Allow up to the service's timeout (default 10 seconds) to try this out.
+func checkHTTPHelper(service string, host string, addr string, port string) (bool, error) {
+	client := checkHTTPClient(service)
+	hostport := addressHostPort(host, addr, port) // Find IP - either internally, or DNS
 	url := "http://" + hostport
 
 	//	log.Printf("checkHTTPHelper checking host %s port %v url %v\n",host,port,url);
@@ -158,36 +241,3 @@ func checkHTTPHelper(host string, port string) (bool, error) {
 	return false, err
 
 }
-
-func checkMirror(hostname string) (bool, error) {
-	b, err := checkMirrorHelper(hostname) // Check the named site first
-	if err == nil && b == true {
-		trimmed := hostname
-		trimmed = strings.TrimPrefix(trimmed, "ds.")
-		trimmed = strings.TrimPrefix(trimmed, "ipv6.")
-		b, err = checkMirrorHelper("mtu1280." + trimmed) // Check also implied mtu1280.site as well
-	}
-	return b, err
-}
-
-func checkMirrorHelper(hostname string) (bool, error) {
-	hostport, _ := LookupAddressHostPort(hostname, "80") // Avoid external DNS lookups
-	url := "http://" + hostport + "/site/config.js"      // Mirrors should have this file
-	seconds := 10                                        // Allow up to 10 seconds to try this out.
-	timeout := time.Duration(seconds) * time.Second      // Nothing is ever easy
-	client := &http.Client{Timeout: timeout}             // Create the client configuration object
-
-	req, err := http.NewRequest("GET", url, nil) // Create the client request object
-	req.Host = "test-ipv6.com"                   // Override the "Host:" field
-	resp, err := client.Do(req)                  // Actually perform the GET
-	if err != nil {
-		return false, err // Return the error
-	}
-	defer resp.Body.Close()                                     // If the request worked, one MUST ALWAYS close the body.  ALWAYS.
-	body, err := ioutil.ReadAll(resp.Body)                      // Grab the body content.
-	b := strings.Contains(string(body), `MirrorConfig`) // Dumbed down.
-	if b {
-	return true,nil
-	}
-	return false,fmt.Errorf("Did not see MirrorConfig in %s",url)
-}
@@ -0,0 +1,176 @@
+package main
+
+/*
+Composite checks.
+
+Combine other checks into one, with all / any / at-least N logic.
+Members are "service target" pairs; {target} is replaced with the
+composite's own target, so members can refer to siblings of the
+target, or to entirely different targets.
+
+[check_mirror_pair]
+type: composite
+mode: all                     # all, any, majority, or "at-least 2"
+member: [check_http {target}, check_http mtu1280.{target}]
+
+Then in zone.conf:
+  HC check_mirror_pair comcast-ct.test-ipv6.com
+
+Members are started as ordinary checks (with their own [interval]),
+along with the composite.  The composite's first poll waits (up to its
+timeout) for the members' first polls, and whenever a member changes,
+the composite is polled again straight away.
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// compositeMembers returns the member checks of a composite check, for a given target.
+func compositeMembers(service string, target string) (members []ServiceTargetKey) {
+	list, _ := GlobalConfig().GetSectionNameValueStrings(service, "member")
+	for _, line := range list {
+		words := strings.Fields(strings.Replace(line, "{target}", target, -1))
+		if len(words) >= 2 {
+			members = append(members, ServiceTargetKey{words[0], words[1]})
+		}
+	}
+	return members
+}
+
+// isComposite returns true for "type: composite" service checks.
+func isComposite(service string) bool {
+	kind, ok := checkParam(service, "type")
+	return ok && kind == "composite"
+}
+
+// addCheckAndMembers starts a check (see AddCheck), and if it is a
+// composite, its members too (and theirs, for composites of composites).
+func addCheckAndMembers(service string, target string) {
+	AddCheck(service, target, checkInterval(service))
+	if !isComposite(service) {
+		return
+	}
+	for _, m := range compositeMembers(service, target) {
+		if isComposite(m.Service) {
+			if _, started := GetStatus(m.Service, m.Target); started {
+				continue // Already done (and don't go round in circles)
+			}
+		}
+		addCheckAndMembers(m.Service, m.Target)
+	}
+}
+
+// wakeComposites polls again every composite check with a given member.
+func wakeComposites(service string, target string) {
+	member := ServiceTargetKey{service, target}
+	woken := []ServiceTargetKey{}
+	HealthChecks.Lock.RLock() // RO
+	for key := range HealthChecks.Info {
+		if !isComposite(key.Service) {
+			continue
+		}
+		for _, m := range compositeMembers(key.Service, key.Target) {
+			if m == member {
+				woken = append(woken, key)
+				break
+			}
+		}
+	}
+	HealthChecks.Lock.RUnlock() // RO
+	for _, key := range woken {
+		wakeCheck(key.Service, key.Target)
+	}
+}
+
+// compositeNeeded parses the "mode" of a composite check, and returns how many
+// of the members must be up for the composite to be up.
+func compositeNeeded(service string, count int) (needed int, err error) {
+	mode, ok := checkParam(service, "mode")
+	if !ok {
+		mode = "all"
+	}
+	needed, err = parseQuorum(mode, count)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", service, err)
+	}
+	return needed, nil
+}
+
+// parseQuorum parses all, any, majority or "at-least N", and returns how
+// many of "count" votes must be up.
+func parseQuorum(mode string, count int) (needed int, err error) {
+	words := strings.Fields(toLower(mode))
+	switch {
+	case len(words) == 1 && words[0] == "all":
+		return count, nil
+	case len(words) == 1 && words[0] == "any":
+		return 1, nil
+	case len(words) == 1 && words[0] == "majority":
+		return count/2 + 1, nil
+	case len(words) == 2 && words[0] == "at-least":
+		if n, err := strconv.Atoi(words[1]); err == nil && n > 0 {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("bad mode %q, wanted all, any, majority, or at-least N", mode)
+}
+
+// checkComposite handles any "type: composite" service check.
+func checkComposite(service string, target string) (bool, error) {
+	members := compositeMembers(service, target)
+	if len(members) == 0 {
+		return false, fmt.Errorf("%s: no members configured", service)
+	}
+	needed, err := compositeNeeded(service, len(members))
+	if err != nil {
+		return false, err
+	}
+
+	// Members that have not been polled yet look down; give them a chance.
+	deadline := time.Now().Add(checkTimeout(service))
+	for _, m := range members {
+		for waitingForPoll(m.Service, m.Target) && time.Now().Before(deadline) {
+			time.Sleep(time.Duration(100) * time.Millisecond)
+		}
+	}
+
+	up := 0
+	failed := []string{}
+	for _, m := range members {
+		if status, _ := GetStatus(m.Service, m.Target); status {
+			up++
+		} else {
+			failed = append(failed, m.Service+" "+m.Target)
+		}
+	}
+	if up >= needed {
+		return true, nil
+	}
+	return false, fmt.Errorf("%v of %v members up, need %v; failed: %s", up, len(members), needed, strings.Join(failed, ", "))
+}
+
+// waitingForPoll returns true if a check is started, but has not finished a poll.
+func waitingForPoll(service string, target string) bool {
+	HealthChecks.Lock.RLock() // RO
+	defer HealthChecks.Lock.RUnlock()
+	info, ok := HealthChecks.Info[ServiceTargetKey{service, target}]
+	return ok && info.Polls == 0
+}
+
+// traceComposite adds the status of each member of a composite check to the trace.
+func traceComposite(service string, target string, recursion int, trace *LookupTrace) {
+	if trace.trace == nil {
+		return
+	}
+	if !isComposite(service) {
+		return
+	}
+	for _, m := range compositeMembers(service, target) {
+		status, _ := GetStatus(m.Service, m.Target)
+		trace.Addf(recursion+1, "member %s %s %v", m.Service, m.Target, status)
+	}
+}
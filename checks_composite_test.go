@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckComposite(t *testing.T) {
+	initGlobal("t/etc")
+
+	var tableCheckComposite = []struct {
+		service string
+		ok      bool
+	}{
+		{"check_unit_all", false},
+		{"check_unit_any", true},
+		{"check_unit_quorum", true},
+	}
+
+	// Started along with the composite, the members are polled before it decides.
+	for _, tt := range tableCheckComposite {
+		addCheckAndMembers(tt.service, "composite.example.com")
+		waitForPoll(tt.service, "composite.example.com")
+		if status, _ := GetStatus(tt.service, "composite.example.com"); status != tt.ok {
+			t.Errorf("%s first poll expected %v, found %v", tt.service, tt.ok, status)
+		}
+	}
+
+	for _, tt := range tableCheckComposite {
+		b, err := dispatchServiceCheck(tt.service, "composite.example.com", "")
+		if b != tt.ok {
+			t.Errorf("%s expected %v, found %v err %v", tt.service, tt.ok, b, err)
+		}
+	}
+}
+
+func TestCompositeNeeded(t *testing.T) {
+	initGlobal("t/etc")
+
+	if n, _ := compositeNeeded("check_unit_all", 3); n != 3 {
+		t.Errorf("compositeNeeded(check_unit_all) expected 3, found %v", n)
+	}
+	if n, _ := compositeNeeded("check_unit_any", 3); n != 1 {
+		t.Errorf("compositeNeeded(check_unit_any) expected 1, found %v", n)
+	}
+	if n, _ := compositeNeeded("check_unit_quorum", 3); n != 2 {
+		t.Errorf("compositeNeeded(check_unit_quorum) expected 2, found %v", n)
+	}
+}
+
+func TestCompositeFollowsMembers(t *testing.T) {
+	initGlobal("t/etc")
+	os.Setenv("EXIT", "0")
+	defer os.Unsetenv("EXIT")
+
+	addCheckAndMembers("check_unit_follow", "follow.example.com")
+	waitForPoll("check_unit_follow", "follow.example.com")
+	if status, _ := GetStatus("check_unit_follow", "follow.example.com"); !status {
+		t.Fatalf("check_unit_follow first poll expected true")
+	}
+
+	// The member goes down; the composite follows, long before its next interval.
+	os.Setenv("EXIT", "1")
+	wakeCheck("check_unit_exec", "follow.example.com")
+	for i := 0; i < 50; i++ {
+		if status, _ := GetStatus("check_unit_follow", "follow.example.com"); !status {
+			return
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+	t.Errorf("check_unit_follow still up after its member went down")
+}
@@ -0,0 +1,145 @@
+package main
+
+/*
+DNS checks.
+
+Sends one query to the target name server, and looks at the reply.
+Parameters come from server.conf, in a section named after the service;
+check_dns is always available with the defaults.
+
+[check_dns_v6ns]
+type: dns
+qname: v6ns.test-ipv6.com   # default: the zone delegated to the target (else its own name)
+qtype: SOA                  # default: SOA of the delegated zone (else A)
+proto: udp                  # or tcp
+rcode: NOERROR              # expected response code (default NOERROR)
+aa: yes                     # require an authoritative answer (default: yes for a delegated zone)
+expect: ^ns1\.              # regex, must match the RDATA of some answer
+timeout: 3
+
+Delegations can use these to leave lame name servers out of the
+NS set and glue:
+
+[delegate]
+v6ns.test-ipv6.com: check_dns_v6ns
+
+With no qname, a name server that zone.conf DELEGATEs a zone to is asked
+for that zone's SOA, and must answer authoritatively; anything else is
+lame.
+*/
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// checkDNS handles check_dns, and any "type: dns" service check.
+func checkDNS(service string, target string, addr string) (bool, error) {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+
+	qname, qtypeStr := host, "A"
+	zone, delegated := delegatedZone(host)
+	if delegated {
+		qname, qtypeStr = zone, "SOA" // Is it authoritative for the zone we send people to it for?
+	}
+	if s, ok := checkParam(service, "qname"); ok {
+		qname = s
+	}
+	if s, ok := checkParam(service, "qtype"); ok {
+		qtypeStr = toUpper(s)
+	}
+	qtype, ok := dns.StringToType[qtypeStr]
+	if !ok {
+		return false, fmt.Errorf("%s: unknown qtype %s", service, qtypeStr)
+	}
+	rcodeStr := "NOERROR"
+	if s, ok := checkParam(service, "rcode"); ok {
+		rcodeStr = toUpper(s)
+	}
+	rcode, ok := dns.StringToRcode[rcodeStr]
+	if !ok {
+		return false, fmt.Errorf("%s: unknown rcode %s", service, rcodeStr)
+	}
+	proto, ok := checkParam(service, "proto")
+	if !ok || proto != "tcp" {
+		proto = "udp"
+	}
+	port, ok := checkParam(service, "port")
+	if !ok {
+		port = "53"
+	}
+	wantAA, ok := GlobalConfig().GetSectionNameValueBool(service, "aa")
+	if !ok {
+		wantAA = delegated
+	}
+
+	var expect *regexp.Regexp
+	if s, ok := checkParam(service, "expect"); ok {
+		var err error
+		expect, err = regexp.Compile(s)
+		if err != nil {
+			return false, fmt.Errorf("%s: bad expect parameter: %v", service, err)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qname), qtype)
+	m.RecursionDesired = false // We are asking the authority, not a resolver
+
+	hostport := addressHostPort(target, addr, port)
+	c := &dns.Client{Net: proto, Timeout: checkTimeout(service), Dialer: checkDialer(service, proto, hostport)}
+	r, _, err := c.Exchange(m, hostport)
+	if err != nil {
+		return false, err
+	}
+	if r.Rcode != rcode {
+		return false, fmt.Errorf("%s %s %s: rcode %s, wanted %s", hostport, qname, qtypeStr, rcodeToString(r.Rcode), rcodeStr)
+	}
+	if wantAA && !r.Authoritative {
+		return false, fmt.Errorf("%s %s %s: not authoritative (lame?)", hostport, qname, qtypeStr)
+	}
+	if expect == nil {
+		return true, nil
+	}
+	for _, rr := range r.Answer {
+		rdata := strings.TrimPrefix(rr.String(), rr.Header().String())
+		if expect.MatchString(rdata) {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("%s %s %s: no answer matching %s", hostport, qname, qtypeStr, expect.String())
+}
+
+// delegateCheck returns the service check (if any) that server.conf
+// wants used for the name servers of a delegated zone.
+func delegateCheck(zone string) (service string, ok bool) {
+	return GlobalConfig().GetSectionNameValueString("delegate", toLower(zone))
+}
+
+// delegatedZone finds a zone that zone.conf DELEGATEs to a name server
+// (the first by name, if there are several).
+func delegatedZone(ns string) (zone string, ok bool) {
+	ns = strings.TrimSuffix(toLower(ns), ".")
+	for _, val := range GlobalZoneData().Data {
+		for _, s := range val.Values {
+			words := strings.Fields(s)
+			if len(words) < 3 || toUpper(words[0]) != "DELEGATE" {
+				continue
+			}
+			for _, to := range words[2:] {
+				from := strings.TrimSuffix(toLower(words[1]), ".")
+				if strings.TrimSuffix(toLower(to), ".") == ns && (!ok || from < zone) {
+					zone, ok = from, true
+				}
+			}
+		}
+	}
+	return zone, ok
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// FakeDNSServer starts an authoritative DNS server on localhost, on a random
+// port, answering every SOA query with the example.com SOA.  Returns the host:port.
+func FakeDNSServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		if r.Question[0].Qtype == dns.TypeSOA {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 SOA ns1.example.com. hostmaster.example.com. 1 10800 3600 604800 86400")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go server.ActivateAndServe()
+	return pc.LocalAddr().String()
+}
+
+func TestCheckDNS(t *testing.T) {
+	initGlobal("t/etc")
+	hostport := FakeDNSServer(t)
+
+	b, err := dispatchServiceCheck("check_unit_dnsq", hostport, "")
+	if b != true {
+		t.Errorf("check_unit_dnsq %s expected true, found %v err %v", hostport, b, err)
+	}
+
+	// check_dns defaults to asking for an A record of a target that serves no delegation;
+	// our fake server has none, but still says NOERROR.
+	b, err = dispatchServiceCheck("check_dns", hostport, "")
+	if b != true {
+		t.Errorf("check_dns %s expected true, found %v err %v", hostport, b, err)
+	}
+}
+
+func TestDelegatedZone(t *testing.T) {
+	initGlobal("t/etc")
+
+	var tests = []struct {
+		ns   string
+		zone string
+		ok   bool
+	}{
+		{"ns1.sub.example.com", "sub.example.com", true},
+		{"NS2.sub.example.com.", "sub.example.com", true},
+		{"ns1.unchecked.example.com", "unchecked.example.com", true},
+		{"ns1.example.com", "", false}, // Serves us, not a delegation
+	}
+	for _, tt := range tests {
+		zone, ok := delegatedZone(tt.ns)
+		if zone != tt.zone || ok != tt.ok {
+			t.Errorf("delegatedZone(%s) = %q %v; wanted %q %v", tt.ns, zone, ok, tt.zone, tt.ok)
+		}
+	}
+}
+
+// waitForPoll waits for the first poll of a service check to finish.
+func waitForPoll(service string, target string) {
+	for i := 0; i < 50; i++ {
+		HealthChecks.Lock.RLock()
+		info, ok := HealthChecks.Info[ServiceTargetKey{service, target}]
+		polled := ok && info.Polls > 0
+		HealthChecks.Lock.RUnlock()
+		if polled {
+			return
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+}
+
+func TestDelegateNSLame(t *testing.T) {
+	initGlobal("t/etc")
+	zoneRef := GlobalZoneData()
+	notrace := NewLookupTraceOff()
+	delegate := "DELEGATE sub.example.com ns1.sub.example.com ns2.sub.example.com"
+
+	// Nobody answers at 192.0.2.0/24; all lame means we hand out everyone.
+	waitForPoll("check_unit_delegate", "ns1.sub.example.com")
+	waitForPoll("check_unit_delegate", "ns2.sub.example.com")
+	ClearCaches("unit testing TestDelegateNSLame")
+	found := fmt.Sprintf("%v", DelegateNS(zoneRef, "www.sub.example.com", "default", delegate, 0, notrace))
+	want := `{[] [sub.example.com. 300 NS ns1.sub.example.com sub.example.com. 300 NS ns2.sub.example.com] [ns1.sub.example.com. 300 A 192.0.2.53 ns2.sub.example.com. 300 A 192.0.2.54] false 0}`
+	if found != want {
+		t.Errorf("DelegateNS() all lame, wanted %v found %v", want, found)
+	}
+
+	// ns1 comes back; ns2 should be left out.
+	SetStatus("check_unit_delegate", "ns1.sub.example.com", true)
+	SetAddressStatus("check_unit_delegate", "ns1.sub.example.com", map[string]bool{"192.0.2.53": true})
+	ClearCaches("unit testing TestDelegateNSLame")
+	found = fmt.Sprintf("%v", DelegateNS(zoneRef, "www.sub.example.com", "default", delegate, 0, notrace))
+	want = `{[] [sub.example.com. 300 NS ns1.sub.example.com] [ns1.sub.example.com. 300 A 192.0.2.53] false 0}`
+	if found != want {
+		t.Errorf("DelegateNS() ns2 lame, wanted %v found %v", want, found)
+	}
+}
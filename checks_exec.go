@@ -0,0 +1,131 @@
+package main
+
+/*
+External command checks.
+
+Some checks are easier to write as scripts.  The command is run with
+the target (and address, if we are checking one address at a time);
+exit code 0 means up.  Parameters come from server.conf, in a section
+named after the service:
+
+[check_mirror_fresh]
+type: exec
+command: /usr/local/libexec/mirror-fresh {target} {addr}
+timeout: 30
+
+{service}, {target} and {addr} are replaced in the command line; they
+are also passed as GSLB_SERVICE, GSLB_TARGET and GSLB_ADDR in the
+environment.  stdout and stderr end up in /gslb/hc (per address).
+
+At the timeout, the command and everything it started (its process
+group) is killed.
+
+No more than [healthcheck] exec_max commands (default 4) run at once,
+across all checks; the rest wait their turn (before taking one of the
+max_inflight slots, so they don't hold up other kinds of check).
+*/
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExecDefaultMax is how many external checks may run at once, if server.conf does not say.
+var ExecDefaultMax = 4
+
+// ExecMaxOutput is how much of a command's output we keep.
+var ExecMaxOutput = 4096
+
+// ExecWaitDelay is how long, after a command exits or is killed, we wait
+// for anything it started to let go of its output.
+var ExecWaitDelay = 2 * time.Second
+
+var execLock sync.Mutex
+var execCond = sync.NewCond(&execLock)
+var execRunning int
+
+// execMax returns the current limit on concurrent external checks.
+func execMax() int {
+	if i, ok := GlobalConfig().GetSectionNameValueInt("healthcheck", "exec_max"); ok && i > 0 {
+		return i
+	}
+	return ExecDefaultMax
+}
+
+// execAcquire waits for a free slot to run an external check.
+func execAcquire() {
+	execLock.Lock()
+	for execRunning >= execMax() {
+		execCond.Wait()
+	}
+	execRunning++
+	execLock.Unlock()
+}
+
+// execRelease gives back a slot taken by execAcquire.
+func execRelease() {
+	execLock.Lock()
+	execRunning--
+	execLock.Unlock()
+	execCond.Broadcast() // The limit may have changed; let every waiter re-check
+}
+
+// isExec returns true for "type: exec" checks.
+func isExec(service string) bool {
+	kind, ok := checkParam(service, "type")
+	return ok && kind == "exec"
+}
+
+// checkExec handles any "type: exec" service check.
+// The caller (runServiceCheck) holds an exec slot.
+func checkExec(service string, target string, addr string) (bool, error) {
+	command, ok := checkParam(service, "command")
+	if !ok {
+		return false, fmt.Errorf("%s: no command configured", service)
+	}
+	replacer := strings.NewReplacer("{service}", service, "{target}", target, "{addr}", addr)
+	args := []string{}
+	for _, word := range QuotedStringToWords(command) {
+		word = strings.Trim(word, `"'`) // QuotedStringToWords keeps the quotes
+		args = append(args, replacer.Replace(word))
+	}
+	if len(args) == 0 {
+		return false, fmt.Errorf("%s: empty command", service)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout(service))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"GSLB_SERVICE="+service,
+		"GSLB_TARGET="+target,
+		"GSLB_ADDR="+addr,
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = ExecWaitDelay
+	execProcessGroup(cmd)
+	err := cmd.Run()
+
+	text := output.String()
+	if len(text) > ExecMaxOutput {
+		text = text[:ExecMaxOutput]
+	}
+	text = strings.TrimSpace(text)
+	SetCheckOutput(service, target, addr, text)
+
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("%s: timed out: %s", args[0], text)
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %v: %s", args[0], err, text)
+	}
+	return true, nil
+}
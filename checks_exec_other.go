@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os/exec"
+
+// execProcessGroup does nothing here; a timeout kills just the command
+// (and WaitDelay stops us waiting on anything it started).
+func execProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckExec(t *testing.T) {
+	initGlobal("t/etc")
+
+	os.Setenv("EXIT", "0")
+	b, err := dispatchServiceCheck("check_unit_exec", "exec.example.com", "192.0.2.1")
+	if b != true {
+		t.Errorf("check_unit_exec exit 0 expected true, found %v err %v", b, err)
+	}
+
+	os.Setenv("EXIT", "1")
+	b, err = dispatchServiceCheck("check_unit_exec", "exec.example.com", "192.0.2.1")
+	if b != false {
+		t.Errorf("check_unit_exec exit 1 expected false, found %v err %v", b, err)
+	}
+	if err == nil || !strings.Contains(err.Error(), "checking exec.example.com 192.0.2.1") {
+		t.Errorf("check_unit_exec exit 1 did not capture output, err %v", err)
+	}
+	os.Unsetenv("EXIT")
+}
+
+func TestCheckExecOutput(t *testing.T) {
+	initGlobal("t/etc")
+	AddCheck("check_unit_exec", "exec.example.com", 3600)
+	waitForPoll("check_unit_exec", "exec.example.com")
+
+	// Each address keeps its own output.
+	os.Setenv("EXIT", "0")
+	dispatchServiceCheck("check_unit_exec", "exec.example.com", "192.0.2.1")
+	dispatchServiceCheck("check_unit_exec", "exec.example.com", "2001:db8::1")
+	os.Unsetenv("EXIT")
+	s := dumpHealthCheckStatusAsText()
+	for _, want := range []string{"192.0.2.1: checking exec.example.com 192.0.2.1", "2001:db8::1: checking exec.example.com 2001:db8::1"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("/gslb/hc lacks %q: %s", want, s)
+		}
+	}
+}
+
+func TestCheckExecTimeout(t *testing.T) {
+	initGlobal("t/etc")
+
+	// The command leaves a child holding its output; the timeout still wins.
+	start := time.Now()
+	b, err := dispatchServiceCheck("check_unit_exec_hang", "exec.example.com", "")
+	if b != false || err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("check_unit_exec_hang expected a timeout, found %v err %v", b, err)
+	}
+	if took := time.Since(start); took > 10*time.Second {
+		t.Errorf("check_unit_exec_hang took %v, with a 1s timeout", took)
+	}
+}
+
+func TestExecLimit(t *testing.T) {
+	initGlobal("t/etc")
+
+	// Take every slot; one more must wait until we give one back.
+	max := execMax()
+	for i := 0; i < max; i++ {
+		execAcquire()
+	}
+	done := make(chan bool)
+	go func() {
+		execAcquire()
+		execRelease()
+		done <- true
+	}()
+	select {
+	case <-time.After(time.Duration(200) * time.Millisecond):
+	case <-done:
+		t.Fatalf("execAcquire() did not wait for a free slot")
+	}
+	for i := 0; i < max; i++ {
+		execRelease()
+	}
+	<-done
+}
+
+func TestExecLimitPollSlot(t *testing.T) {
+	initGlobal("t/etc")
+
+	// An exec check waiting for its turn does not hold a poll slot.
+	max := execMax()
+	for i := 0; i < max; i++ {
+		execAcquire()
+	}
+	pollLock.Lock()
+	before := pollRunning
+	pollLock.Unlock()
+	done := make(chan bool)
+	go func() {
+		runServiceCheck("check_unit_exec", "exec-limit.example.com")
+		done <- true
+	}()
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	pollLock.Lock()
+	waiting := pollRunning
+	pollLock.Unlock()
+	if waiting != before {
+		t.Errorf("waiting for an exec slot holds %v poll slots", waiting-before)
+	}
+	for i := 0; i < max; i++ {
+		execRelease()
+	}
+	<-done
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// FakeGRPCServer starts a gRPC server on localhost, on a random port,
+// with the standard health service.  "" is SERVING, unit.Down is NOT_SERVING.
+func FakeGRPCServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	hs := health.NewServer()
+	hs.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("unit.Down", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	s := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(s, hs)
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func TestCheckGRPC(t *testing.T) {
+	initGlobal("t/etc")
+	hostport := FakeGRPCServer(t)
+
+	b, err := dispatchServiceCheck("check_grpc", hostport, "")
+	if b != true {
+		t.Errorf("check_grpc %s expected true, found %v err %v", hostport, b, err)
+	}
+	b, err = dispatchServiceCheck("check_unit_grpc_down", hostport, "")
+	if b != false {
+		t.Errorf("check_unit_grpc_down %s expected false, found %v err %v", hostport, b, err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+/*
+Mirror content checks.
+
+These fetch a page over HTTP, with a Host: header of our choosing, and
+look at what came back.  Every assertion must hold: each "expect" is a
+regular expression the body must match, and each "json" is a path into
+the body (parsed as JSON) that must exist, or must equal a value.  Once
+the site itself passes, each "sibling" is checked the same way.
+
+[check_status_mirror]
+type: mirror
+host: status.example.com                 # Host: header; default is the target
+path: /health.json                       # default /
+port: 8080                               # default 80
+expect: [ok, ^\{]                        # regular expressions; all must match
+json: [status=ok, checks.0.name]         # path=value, or just path (must exist)
+strip: [www.]                            # prefixes removed from the target, giving {base}
+sibling: [static.{base}]                 # also checked; {target} and {base} are expanded
+timeout: 5
+
+check_mirror is the falling-sky transparent mirror check; it is the same
+as this, with its settings built in (any of which a [check_mirror]
+section may change):
+
+[check_mirror]
+host: test-ipv6.com
+path: /site/config.js
+expect: MirrorConfig
+strip: [ds., ipv6.]
+sibling: mtu1280.{base}
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mirrorPreset holds the built in settings of check_mirror.
+var mirrorPreset = map[string][]string{
+	"host":    {"test-ipv6.com"},
+	"path":    {"/site/config.js"},
+	"expect":  {"MirrorConfig"},
+	"strip":   {"ds.", "ipv6."},
+	"sibling": {"mtu1280.{base}"},
+}
+
+// mirrorParams looks up a (possibly repeated) parameter of a mirror check.
+// server.conf wins over the check_mirror preset.
+func mirrorParams(service string, name string) []string {
+	if values, ok := GlobalConfig().GetSectionNameValueStrings(service, name); ok {
+		return values
+	}
+	if service == "check_mirror" {
+		return mirrorPreset[name]
+	}
+	return nil
+}
+
+// mirrorParam is mirrorParams, for parameters that take one value.
+func mirrorParam(service string, name string, def string) string {
+	if values := mirrorParams(service, name); len(values) > 0 {
+		return values[0]
+	}
+	return def
+}
+
+// checkMirror checks a site, then its siblings (over the same address family, if we can).
+func checkMirror(service string, hostname string, addr string) (bool, error) {
+	b, err := checkMirrorContent(service, hostname, addr) // Check the named site first
+	if err != nil || b != true {
+		return b, err
+	}
+	for _, sibling := range mirrorSiblings(service, hostname) {
+		if b, err = checkMirrorContent(service, sibling, sameFamilyAddress(sibling, addr)); err != nil || b != true {
+			return b, err
+		}
+	}
+	return true, nil
+}
+
+// mirrorSiblings expands the sibling patterns of a service, for one site.
+func mirrorSiblings(service string, hostname string) []string {
+	base := hostname
+	for _, prefix := range mirrorParams(service, "strip") {
+		base = strings.TrimPrefix(base, prefix)
+	}
+	ret := []string{}
+	for _, pattern := range mirrorParams(service, "sibling") {
+		ret = append(ret, strings.Replace(strings.Replace(pattern, "{target}", hostname, -1), "{base}", base, -1))
+	}
+	return ret
+}
+
+// checkMirrorHelper checks one site with the check_mirror settings, without siblings.
+func checkMirrorHelper(hostname string, addr string) (bool, error) {
+	return checkMirrorContent("check_mirror", hostname, addr)
+}
+
+// checkMirrorContent fetches one site, and tests every content assertion of the service.
+func checkMirrorContent(service string, hostname string, addr string) (bool, error) {
+	hostport := addressHostPort(hostname, addr, mirrorParam(service, "port", "80")) // Avoid external DNS lookups
+	url := "http://" + hostport + mirrorParam(service, "path", "/")
+	client := checkHTTPClient(service)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Host = strings.Replace(mirrorParam(service, "host", hostname), "{target}", hostname, -1) // Override the "Host:" field
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close() // If the request worked, one MUST ALWAYS close the body.  ALWAYS.
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range mirrorParams(service, "expect") {
+		unquoted, err := unquoteParam(s)
+		if err != nil {
+			return false, fmt.Errorf("%s: bad expect parameter: %v", service, err)
+		}
+		re, err := regexp.Compile(unquoted)
+		if err != nil {
+			return false, fmt.Errorf("%s: bad expect parameter: %v", service, err)
+		}
+		if !re.Match(body) {
+			return false, fmt.Errorf("Did not see %s in %s", unquoted, url)
+		}
+	}
+
+	assertions := mirrorParams(service, "json")
+	if len(assertions) == 0 {
+		return true, nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return false, fmt.Errorf("%s is not JSON: %v", url, err)
+	}
+	for _, assertion := range assertions {
+		if err := jsonAssert(doc, assertion); err != nil {
+			return false, fmt.Errorf("%s: %v", url, err)
+		}
+	}
+	return true, nil
+}
+
+// jsonAssert tests "path" (must exist) or "path=value" (must equal) against a JSON document.
+// Paths are dotted; array elements are numbered from 0.
+func jsonAssert(doc interface{}, assertion string) error {
+	path, want, compare := assertion, "", false
+	if i := strings.Index(assertion, "="); i >= 0 {
+		path, want, compare = strings.TrimSpace(assertion[:i]), strings.TrimSpace(assertion[i+1:]), true
+	}
+	v, ok := jsonPath(doc, path)
+	if !ok {
+		return fmt.Errorf("json %s missing", path)
+	}
+	if !compare {
+		return nil
+	}
+	got := fmt.Sprintf("%v", v)
+	if s, isString := v.(string); isString {
+		got = s
+	} else if b, err := json.Marshal(v); err == nil {
+		got = string(b) // Numbers, booleans, null, as written in JSON
+	}
+	if unquoted, err := unquoteParam(want); err == nil {
+		want = unquoted
+	}
+	if got != want {
+		return fmt.Errorf("json %s is %s, wanted %s", path, got, want)
+	}
+	return nil
+}
+
+// jsonPath walks a dotted path through a JSON document.
+func jsonPath(doc interface{}, path string) (interface{}, bool) {
+	v := doc
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
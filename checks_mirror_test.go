@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckMirrorContent(t *testing.T) {
+	initGlobal("t/etc")
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "unit-mirror.example.com" || r.URL.Path != "/health.json" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&hits, 1)
+		io.WriteString(w, `{"status": "ok", "up": true, "checks": [{"name": "disk"}]}`)
+	}))
+	defer ts.Close()
+	target := strings.TrimPrefix(ts.URL, "http://")
+
+	var tests = []struct {
+		service string
+		want    bool
+		err     string
+	}{
+		{"check_unit_mirror", true, ""},
+		{"check_unit_mirror_json", false, "json status is ok, wanted down"},
+		{"check_mirror", false, "Did not see MirrorConfig"}, // Wrong path and Host:
+	}
+	for _, tt := range tests {
+		b, err := dispatchServiceCheck(tt.service, target, "")
+		if b != tt.want || (tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err))) {
+			t.Errorf("%s %s = %v %v, wanted %v %q", tt.service, target, b, err, tt.want, tt.err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n < 3 {
+		t.Errorf("check_unit_mirror fetched %v times; wanted the site and its sibling", n)
+	}
+}
+
+func TestMirrorSiblings(t *testing.T) {
+	initGlobal("t/etc")
+	var tests = []struct {
+		service string
+		target  string
+		want    []string
+	}{
+		{"check_mirror", "ds.comcast.test-ipv6.com", []string{"mtu1280.comcast.test-ipv6.com"}},
+		{"check_mirror", "ipv6.comcast.test-ipv6.com", []string{"mtu1280.comcast.test-ipv6.com"}},
+		{"check_mirror", "comcast.test-ipv6.com", []string{"mtu1280.comcast.test-ipv6.com"}},
+		{"check_unit_mirror", "a.example.com", []string{"a.example.com"}},
+		{"check_unit_mirror_json", "a.example.com", []string{}},
+	}
+	for _, tt := range tests {
+		if found := mirrorSiblings(tt.service, tt.target); !reflect.DeepEqual(found, tt.want) {
+			t.Errorf("mirrorSiblings(%s, %s) = %v, wanted %v", tt.service, tt.target, found, tt.want)
+		}
+	}
+}
+
+func TestJSONAssert(t *testing.T) {
+	doc := map[string]interface{}{
+		"status": "ok",
+		"count":  float64(3),
+		"up":     true,
+		"checks": []interface{}{map[string]interface{}{"name": "disk"}},
+	}
+	var tests = []struct {
+		assertion string
+		ok        bool
+	}{
+		{"status", true},
+		{"status=ok", true},
+		{`status="ok"`, true},
+		{"status=down", false},
+		{"count=3", true},
+		{"up=true", true},
+		{"checks.0.name=disk", true},
+		{"checks.1.name", false},
+		{"missing", false},
+	}
+	for _, tt := range tests {
+		if err := jsonAssert(doc, tt.assertion); (err == nil) != tt.ok {
+			t.Errorf("jsonAssert(%s) = %v, wanted ok=%v", tt.assertion, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+/*
+Health check scheduling and source addresses.
+
+Every check polls on its own schedule, but no more than max_inflight
+polls run at once (the rest wait their turn), and newly added checks
+start stagger_ms apart, so hundreds of targets don't all fire at
+startup.
+
+On multi-homed name servers, checks can leave from a chosen address
+for each address family:
+
+[healthcheck]
+max_inflight: 64          # default 64; 0 means no limit
+stagger_ms: 20            # default 0: start right away
+source4: 192.0.2.53
+source6: 2001:db8::53
+
+A check's own section may set source4, source6 (and timeout) too.
+*/
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PollDefaultMax is how many polls may run at once, if server.conf does not say.
+var PollDefaultMax = 64
+
+var pollLock sync.Mutex
+var pollCond = sync.NewCond(&pollLock)
+var pollRunning int
+
+// pollMax returns the current limit on concurrent polls; 0 means none.
+func pollMax() int {
+	if i, ok := GlobalConfig().GetSectionNameValueInt("healthcheck", "max_inflight"); ok && i >= 0 {
+		return i
+	}
+	return PollDefaultMax
+}
+
+// pollAcquire waits for a free slot to poll a check.
+func pollAcquire() {
+	pollLock.Lock()
+	for max := pollMax(); max > 0 && pollRunning >= max; max = pollMax() {
+		pollCond.Wait()
+	}
+	pollRunning++
+	pollLock.Unlock()
+}
+
+// pollRelease gives back a slot taken by pollAcquire.
+func pollRelease() {
+	pollLock.Lock()
+	pollRunning--
+	pollLock.Unlock()
+	pollCond.Broadcast() // The limit may have changed; let every waiter re-check
+}
+
+var staggerLock sync.Mutex
+var staggerNext time.Time // When the next new check may start
+
+// staggerDelay is how long a newly added check should wait before its first poll.
+func staggerDelay() time.Duration {
+	ms, ok := GlobalConfig().GetSectionNameValueInt("healthcheck", "stagger_ms")
+	if !ok || ms <= 0 {
+		return 0
+	}
+	step := time.Duration(ms) * time.Millisecond
+	staggerLock.Lock()
+	defer staggerLock.Unlock()
+	now := time.Now()
+	start := now
+	if staggerNext.After(now) {
+		start = staggerNext
+	}
+	staggerNext = start.Add(step)
+	return start.Sub(now)
+}
+
+// checkSource returns the source address (if any) a check should use, to reach ip.
+func checkSource(service string, ip net.IP) net.IP {
+	name := "source6"
+	if ip.To4() != nil {
+		name = "source4"
+	}
+	s, ok := checkParam(service, name)
+	if !ok {
+		s, ok = GlobalConfig().GetSectionNameValueString("healthcheck", name)
+	}
+	if !ok {
+		return nil
+	}
+	return net.ParseIP(s)
+}
+
+// checkDialer returns a dialer for a check, bound to the right source address for hostport.
+func checkDialer(service string, network string, hostport string) *net.Dialer {
+	d := &net.Dialer{Timeout: checkTimeout(service)}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return d
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return d
+	}
+	if src := checkSource(service, ip); src != nil {
+		switch network {
+		case "udp", "udp4", "udp6":
+			d.LocalAddr = &net.UDPAddr{IP: src}
+		default:
+			d.LocalAddr = &net.TCPAddr{IP: src}
+		}
+	}
+	return d
+}
+
+// checkDial connects for a check, from the right source address.
+// Names are resolved here, so that each address gets its own family's source.
+func checkDial(ctx context.Context, service string, network string, hostport string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil || net.ParseIP(host) != nil {
+		return checkDialer(service, network, hostport).DialContext(ctx, network, hostport)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.IP.String(), port)
+		var c net.Conn
+		if c, err = checkDialer(service, network, addr).DialContext(ctx, network, addr); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// checkDialTimeout is net.DialTimeout, for a check.
+func checkDialTimeout(service string, network string, hostport string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout(service))
+	defer cancel()
+	return checkDial(ctx, service, network, hostport)
+}
+
+// checkHTTPClient returns an http.Client for a check, with its timeout and source addresses.
+func checkHTTPClient(service string) *http.Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, hostport string) (net.Conn, error) {
+			return checkDial(ctx, service, network, hostport)
+		},
+		DisableKeepAlives: true, // One poll, one connection
+	}
+	return &http.Client{Timeout: checkTimeout(service), Transport: transport}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPollLimit(t *testing.T) {
+	initGlobal("t/etc")
+
+	// Take every slot; one more must wait until we give one back.
+	max := pollMax()
+	for i := 0; i < max; i++ {
+		pollAcquire()
+	}
+	done := make(chan bool)
+	go func() {
+		pollAcquire()
+		pollRelease()
+		done <- true
+	}()
+	select {
+	case <-time.After(time.Duration(200) * time.Millisecond):
+	case <-done:
+		t.Fatalf("pollAcquire() did not wait for a free slot")
+	}
+	for i := 0; i < max; i++ {
+		pollRelease()
+	}
+	<-done
+}
+
+func TestStaggerDelay(t *testing.T) {
+	initGlobal("t/etc")
+	first := staggerDelay()
+	second := staggerDelay()
+	if second <= first || second-first < time.Duration(4)*time.Millisecond {
+		t.Errorf("staggerDelay() gave %v then %v; wanted them about 5ms apart", first, second)
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	initGlobal("t/etc")
+	remote := make(chan string, 1)
+	hostport := FakeTCPServer(t, func(c net.Conn) {
+		remote <- c.RemoteAddr().String()
+	})
+
+	var tests = []struct {
+		service string
+		source  string
+	}{
+		{"check_unit_source", "127.0.0.2"},
+		{"check_tcp", "127.0.0.1"}, // No source4; the kernel picks
+	}
+	for _, tt := range tests {
+		c, err := checkDialTimeout(tt.service, "tcp", hostport)
+		if err != nil {
+			t.Fatalf("checkDialTimeout(%s) failed: %v", tt.service, err)
+		}
+		c.Close()
+		if host, _, _ := net.SplitHostPort(<-remote); host != tt.source {
+			t.Errorf("%s connected from %s, wanted %s", tt.service, host, tt.source)
+		}
+	}
+
+	if ok, err := checkTCP("check_unit_source", hostport, ""); !ok {
+		t.Errorf("checkTCP(check_unit_source) failed: %v", err)
+	}
+	if d := checkDialer("check_unit_source", "udp", "[::1]:53"); d.LocalAddr != nil {
+		t.Errorf("check_unit_source bound IPv6 to %v; it only has source4", d.LocalAddr)
+	}
+}
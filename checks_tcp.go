@@ -0,0 +1,170 @@
+package main
+
+/*
+Generic TCP and UDP checks.
+
+These connect to host:port, optionally send a payload, and optionally
+match the reply against a regular expression.  Nothing here is specific
+to any one protocol; the parameters come from server.conf, in a section
+named after the service.
+
+[check_smtp]
+type: tcp
+port: 25
+expect: ^220
+
+[check_redis]
+type: tcp
+port: 6379
+send: "PING\r\n"
+expect: ^\+PONG
+
+[check_dns_raw]
+type: udp
+port: 53
+send_hex: 12340100000100000000000004746573740000010001
+timeout: 3
+
+Then in zone.conf:
+  HC check_smtp mail.example.com
+
+check_tcp is always available, and simply connects: "HC check_tcp host:port".
+The name answers with host's addresses; the port is only for the check.
+*/
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkParam looks up a parameter for a service check.  Parameters live
+// in server.conf, in a section named after the service.
+// Use only if "ok".
+func checkParam(service string, name string) (value string, ok bool) {
+	return GlobalConfig().GetSectionNameValueString(service, name)
+}
+
+// checkParamInt looks up a numeric parameter for a service check,
+// with a default if it is missing (or not a number).
+func checkParamInt(service string, name string, def int) int {
+	if i, ok := GlobalConfig().GetSectionNameValueInt(service, name); ok {
+		return i
+	}
+	return def
+}
+
+// checkTimeout is how long any one poll of a service is allowed to take.
+func checkTimeout(service string) time.Duration {
+	return time.Duration(checkParamInt(service, "timeout", 10)) * time.Second
+}
+
+// unquoteParam turns a quoted config value like "PING\r\n" into the bytes it describes.
+// Unquoted values are taken literally (handy for regular expressions).
+func unquoteParam(s string) (string, error) {
+	if strings.HasPrefix(s, `"`) {
+		return strconv.Unquote(s)
+	}
+	return s, nil
+}
+
+// checkTCP handles both "tcp" and "udp" type service checks.
+func checkTCP(service string, target string, addr string) (bool, error) {
+	proto, ok := checkParam(service, "type")
+	if !ok || proto != "udp" {
+		proto = "tcp"
+	}
+	port, _ := checkParam(service, "port")
+	if _, p, err := net.SplitHostPort(target); err == nil {
+		port = p
+	}
+	if port == "" {
+		return false, fmt.Errorf("%s: no port for %s", service, target)
+	}
+
+	// What, if anything, do we send?
+	var payload []byte
+	if s, ok := checkParam(service, "send"); ok {
+		unquoted, err := unquoteParam(s)
+		if err != nil {
+			return false, fmt.Errorf("%s: bad send parameter: %v", service, err)
+		}
+		payload = []byte(unquoted)
+	}
+	if s, ok := checkParam(service, "send_hex"); ok {
+		decoded, err := hex.DecodeString(s)
+		if err != nil {
+			return false, fmt.Errorf("%s: bad send_hex parameter: %v", service, err)
+		}
+		payload = decoded
+	}
+
+	// What, if anything, do we expect back?
+	var expect *regexp.Regexp
+	if s, ok := checkParam(service, "expect"); ok {
+		unquoted, err := unquoteParam(s)
+		if err != nil {
+			return false, fmt.Errorf("%s: bad expect parameter: %v", service, err)
+		}
+		expect, err = regexp.Compile(unquoted)
+		if err != nil {
+			return false, fmt.Errorf("%s: bad expect parameter: %v", service, err)
+		}
+	}
+	if proto == "udp" && payload == nil {
+		return false, fmt.Errorf("%s: udp checks need send or send_hex", service)
+	}
+
+	hostport := addressHostPort(target, addr, port)
+	return checkSendExpect(service, proto, hostport, payload, expect)
+}
+
+// checkSendExpect connects, sends the payload (if any), and reads until
+// the reply matches expect.  With no expect, a TCP connection alone is
+// good enough; UDP needs some reply, any reply.
+func checkSendExpect(service string, proto string, hostport string, payload []byte, expect *regexp.Regexp) (bool, error) {
+	timeout := checkTimeout(service)
+	c, err := checkDialTimeout(service, proto, hostport)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	if len(payload) > 0 {
+		if _, err := c.Write(payload); err != nil {
+			return false, err
+		}
+	}
+	if expect == nil && proto == "tcp" {
+		return true, nil
+	}
+
+	pattern := "any reply"
+	if expect != nil {
+		pattern = expect.String()
+	}
+	reply := []byte{}
+	buf := make([]byte, 4096)
+	for len(reply) < 4096 { // Anything worth matching is in the first few kB
+		n, err := c.Read(buf)
+		reply = append(reply, buf[:n]...)
+		if expect == nil && n > 0 {
+			return true, nil // UDP; any reply will do
+		}
+		if expect != nil && expect.Match(reply) {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s %s: no match for %q in %q: %v", proto, hostport, pattern, reply, err)
+		}
+		if proto == "udp" {
+			break // One datagram is all we get
+		}
+	}
+	return false, fmt.Errorf("%s %s: no match for %q in %q", proto, hostport, pattern, reply)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// FakeTCPServer starts a TCP server on localhost, on a random port, which
+// calls handler for each connection.  Returns the host:port.
+func FakeTCPServer(t *testing.T, handler func(net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handler(c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// FakeUDPEcho starts a UDP echo server on localhost, on a random port.
+func FakeUDPEcho(t *testing.T) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			c.WriteTo(buf[:n], addr)
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+func TestCheckTCP(t *testing.T) {
+	initGlobal("t/etc")
+
+	banner := FakeTCPServer(t, func(c net.Conn) {
+		c.Write([]byte("220 mail.example.com ESMTP\r\n"))
+	})
+	pingpong := FakeTCPServer(t, func(c net.Conn) {
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		if line == "PING\r\n" {
+			c.Write([]byte("+PONG\r\n"))
+		} else {
+			c.Write([]byte("-ERR\r\n"))
+		}
+	})
+	silent := FakeTCPServer(t, func(c net.Conn) {})
+	echo := FakeUDPEcho(t)
+
+	var tableCheckTCP = []struct {
+		service string
+		target  string
+		ok      bool
+	}{
+		{"check_tcp", banner, true},
+		{"check_unit_banner", banner, true},
+		{"check_unit_banner", silent, false},
+		{"check_unit_pingpong", pingpong, true},
+		{"check_unit_pingpong", banner, false},
+		{"check_unit_udp", echo, true},
+	}
+
+	for _, tt := range tableCheckTCP {
+		b, err := dispatchServiceCheck(tt.service, tt.target, "")
+		if b != tt.ok {
+			t.Errorf("dispatchServiceCheck(%v,%v) expected %v found %v err %v", tt.service, tt.target, tt.ok, b, err)
+		}
+	}
+}
+
+func TestCheckTCPHostPort(t *testing.T) {
+	initGlobal("t/etc")
+
+	// The host of "HC check_tcp host:port" is a zone.conf name.
+	_, port, _ := net.SplitHostPort(FakeTCPServer(t, func(c net.Conn) {}))
+	if b, err := dispatchServiceCheck("check_tcp", "lo.example.com:"+port, ""); !b {
+		t.Errorf("dispatchServiceCheck(check_tcp, lo.example.com:%s) failed: %v", port, err)
+	}
+
+	// And the name answers with the host's addresses, up or down.
+	waitForPoll("check_tcp", "lo.example.com:9")
+	found := fmt.Sprintf("%s", LookupBackEnd("tcpport.example.com", "default", false, GlobalZoneData(), 0, NewLookupTraceOff()))
+	if found != `[A 127.0.0.1]` {
+		t.Errorf("LookupBackEnd(tcpport.example.com) found %s", found)
+	}
+}
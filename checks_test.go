@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -56,7 +57,7 @@ func TestCheckHttpDown(t *testing.T) {
 	initGlobal("t/etc")
 	FakeWebServer(t)
 
-	b, err := checkHTTP(WebServerHostPort)
+	b, err := checkHTTP(WebServerHostPort, "")
 	if b != true {
 		t.Logf("checkHTTP(%s) good", WebServerHostPort)
 	} else {
@@ -70,7 +71,7 @@ func TestCheckHttpUp(t *testing.T) {
 	FakeWebServer(t)
 	http.HandleFunc("/", FakeMirrorJsConfig)
 
-	b, err := checkHTTP(WebServerHostPort)
+	b, err := checkHTTP(WebServerHostPort, "")
 	if b == true {
 		t.Logf("checkHTTP(%s) good", WebServerHostPort)
 	} else {
@@ -84,7 +85,7 @@ func TestCheckMirrorHelper(t *testing.T) {
 	FakeWebServer(t)
 	http.HandleFunc("/site/config.js", FakeMirrorJsConfig)
 
-	b, err := checkMirrorHelper(WebServerHostPort)
+	b, err := checkMirrorHelper(WebServerHostPort, "")
 	if b == true {
 		t.Logf("checkMirrorHelper(%s) good", WebServerHostPort)
 	} else {
@@ -142,3 +143,58 @@ func TestLookupLookupAddressHostPort(t *testing.T) {
 		}
 	}
 }
+
+var tableLookupAddresses = []struct {
+	name string
+	out  string
+}{
+	{"a.example.com", "[192.0.2.1]"},
+	{"ds.example.com", "[192.0.2.1 2001:db8::1]"},
+	{"expand.example.com", "[192.0.2.1 2001:db8::1]"},
+	{"offhost.example.net", "[]"},
+}
+
+func TestLookupAddresses(t *testing.T) {
+	initGlobal("t/etc")
+
+	for _, tt := range tableLookupAddresses {
+		found := fmt.Sprintf("%v", LookupAddresses(tt.name))
+		if found != tt.out {
+			t.Errorf("LookupAddresses(%v) expected %v found %v", tt.name, tt.out, found)
+		}
+	}
+}
+
+func TestFilterFailedAddresses(t *testing.T) {
+	initGlobal("t/etc")
+	notrace := NewLookupTraceOff()
+
+	// Nothing known per address: everything passes.
+	in := []string{"A 192.0.2.1", "AAAA 2001:db8::1", "TXT hello"}
+	found := fmt.Sprintf("%v", filterFailedAddresses("check_unit", "ds.example.com", in, 0, notrace))
+	if found != "[A 192.0.2.1 AAAA 2001:db8::1 TXT hello]" {
+		t.Errorf("filterFailedAddresses() without address status, found %v", found)
+	}
+
+	// Start a real check, and wait for it to poll both addresses once.
+	AddCheck("check_true", "ds.example.com", 3600)
+	for i := 0; i < 50; i++ {
+		if _, ok := GetAddressStatus("check_true", "ds.example.com", "2001:db8::1"); ok {
+			break
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+
+	// IPv6 broken, IPv4 fine: only the AAAA goes away.
+	SetAddressStatus("check_true", "ds.example.com", map[string]bool{"192.0.2.1": true, "2001:db8::1": false})
+	found = fmt.Sprintf("%v", filterFailedAddresses("check_true", "ds.example.com", in, 0, notrace))
+	if found != "[A 192.0.2.1 TXT hello]" {
+		t.Errorf("filterFailedAddresses() with a failed AAAA, found %v", found)
+	}
+
+	// Zone lines may be written in lower case.
+	found = fmt.Sprintf("%v", filterFailedAddresses("check_true", "ds.example.com", []string{"a 192.0.2.1", "aaaa 2001:db8::1"}, 0, notrace))
+	if found != "[a 192.0.2.1]" {
+		t.Errorf("filterFailedAddresses() with a lower case aaaa, found %v", found)
+	}
+}
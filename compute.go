@@ -30,8 +30,11 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"net"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -167,6 +170,11 @@ func LookupFrontEndNoCache(qname string, view string, qtype string, recursion in
 			return DelegateNS(zoneRef, qname, view, lookup, recursion+1, trace)
 		}
 
+		// Every health checked target is down; on-all-down said what to do.
+		if rtype == "ALLDOWN" {
+			return allDownResults(zoneRef, qname, view, lookup, recursion+1, trace)
+		}
+
 		// CNAME send away immediately.
 		// CNAME does not permit multiple RR types
 		if rtype == "CNAME" {
@@ -282,14 +290,38 @@ func DelegateNS(zoneRef *Config, qname string, view string, delegate string, rec
 
 	if len(words) >= 3 {
 		_, from, toList := words[0], words[1], words[2:]
+
+		// Leave out any lame name servers, if the delegation is health checked.
+		// If they all look lame, hand them all out anyways; same as HC does.
+		service, checked := delegateCheck(from)
+		if checked {
+			alive := []string{}
+			for _, to := range toList {
+				up, _ := GetStatus(service, to)
+				trace.Addf(recursion, "DELEGATE %s %s %s %v", from, service, to, up)
+				if up {
+					alive = append(alive, to)
+				}
+			}
+			if len(alive) > 0 {
+				toList = alive
+			} else {
+				trace.Addf(recursion, "DELEGATE %s: all name servers failed %s, using all", from, service)
+				checked = false
+			}
+		}
+
 		for _, to := range toList {
 
 			// Add in the NS to AUTH
 			s := fmt.Sprintf("%s. %v NS %s", from, TheOneAndOnlyTTL, to)
-			results.Auth = append(results.Add, s)
+			results.Auth = append(results.Auth, s)
 
 			// Add in the glue for additional
 			ipList := LookupBackEnd(to, view, false, zoneRef, recursion+1, trace)
+			if checked {
+				ipList = filterFailedAddresses(service, to, ipList, recursion, trace)
+			}
 			for _, record := range ipList {
 				r := parseTokenFromString(record)
 				if r == "A" || r == "AAAA" {
@@ -408,6 +440,15 @@ func CreateRRString(line string, resourceName string) (record string) {
 // No glue work is done; no evaluating the results is done.  Just simple expansion
 // with health checks factored in.
 func LookupBackEnd(qname string, view string, skipHC bool, zoneRef *Config, recursion int, trace *LookupTrace) []string {
+	lines, _ := lookupBackEnd(qname, view, skipHC, false, zoneRef, recursion, trace)
+	return lines
+}
+
+// lookupBackEnd does the work for LookupBackEnd.  Names pulled in by EXPAND,
+// CNAME or FB are "nested": when all their health checked targets are down
+// they add nothing and report allDown, and ON-ALL-DOWN is left to the name
+// being answered.
+func lookupBackEnd(qname string, view string, skipHC bool, nested bool, zoneRef *Config, recursion int, trace *LookupTrace) (returnData []string, allDown bool) {
 
 	if trace != nil {
 		trace.Addf(recursion, "LookupBackEnd(%s,%s,%v)", qname, view, skipHC)
@@ -419,12 +460,12 @@ func LookupBackEnd(qname string, view string, skipHC bool, zoneRef *Config, recu
 	}
 
 	// Check the cache. If found, return the cached values.
-	QI := LookupBEKey{qname: qname, view: view, skipHC: skipHC}
+	QI := LookupBEKey{qname: qname, view: view, skipHC: skipHC, nested: nested}
 	if cached, ok := CacheLookupBE.Get(QI); ok {
-		return cached
+		return cached, false
 	}
 
-	returnData := []string{} // Container to return results to the caller
+	returnData = []string{} // Container to return results to the caller
 
 	found, ok := zoneRef.GetSectionNameValueStrings(view, qname) // Find the view-specific (or default) strings for the name
 
@@ -434,7 +475,27 @@ func LookupBackEnd(qname string, view string, skipHC bool, zoneRef *Config, recu
 	loop:
 		for _, line := range found {
 			words := QuotedStringToWords(line) // Tokenize for processing
-			token := toUpper(words[0])         // Simplifies checking if we only look at all-caps
+
+			// Time windows (during=, except=) decide if the line applies right now.
+			if hasTimeQualifiers(line, words) {
+				stripped, active, err := timeQualifiers(words, time.Now())
+				if err != nil {
+					log.Printf("LookupBackEnd: %s: %s: %v\n", qname, line, err)
+				}
+				trace.Addf(recursion, "%s (time window %v)", line, active)
+				if !active || len(stripped) == 0 {
+					continue loop
+				}
+				words = stripped
+				line = strings.Join(words, " ")
+			}
+			token := toUpper(words[0]) // Simplifies checking if we only look at all-caps
+			hc, hcTarget := "", ""     // Set if this line came from a health check
+
+			// What to do if every HC fails; see alldown.go
+			if token == "ON-ALL-DOWN" {
+				continue loop
+			}
 
 			// Health checks. If the HC is good, translate into an EXPAND.
 			// If the HC is bad, then simply skip the line.
@@ -442,15 +503,29 @@ func LookupBackEnd(qname string, view string, skipHC bool, zoneRef *Config, recu
 			if token == "HC" {
 				if len(words) >= 3 {
 					hcFound = true
-					hc := words[1]
+					hc = words[1]
 					target := words[2]
 					keep, _ := GetStatus(hc, target)
+					state := GetState(hc, target)
 					if trace != nil {
-						trace.Add(recursion, fmt.Sprintf("HC %s %s %v", hc, target, keep))
+						trace.Add(recursion, fmt.Sprintf("HC %s %s %v (%v)", hc, target, keep, state))
+						traceComposite(hc, target, recursion, trace) // Which sub-checks failed?
+					}
+					if o, ok := GetOverride(target); ok {
+						trace.Addf(recursion, "HC %s %s OVERRIDE %v", hc, target, o)
+						if o.Mode == "drain" {
+							continue loop // Drained by an operator; even skipHC won't bring it back
+						}
+					}
+					// Degraded (slow) targets are only used if nothing better is on offer.
+					if state == StateDegraded && !skipHC && healthyHC(found) {
+						trace.Addf(recursion, "HC %s %s degraded, and healthy targets exist; skipping", hc, target)
+						continue loop
 					}
 					if keep || skipHC {
-						words = []string{"EXPAND", target}
+						words = []string{"EXPAND", hcHost(target)} // The name, without any :port the check uses
 						token = "EXPAND"
+						hcTarget = target
 						// We will continue processing this line, don't exit early.
 					} else {
 						continue loop // Skip this line.  It is dead to us.
@@ -480,9 +555,21 @@ func LookupBackEnd(qname string, view string, skipHC bool, zoneRef *Config, recu
 				if len(words) >= 2 {
 					try := words[1]
 
+					// Drained targets are left out, however they are reached.
+					if token != "CNAME" && hcTarget == "" && Drained(try) {
+						trace.Addf(recursion, "%s %s drained; skipping", words[0], try)
+						continue loop
+					}
+
 					trace.Addf(recursion, "%s %s", words[0], words[1])
 
-					more := LookupBackEnd(try, view, skipHC, zoneRef, recursion+1, trace)
+					more, moreDown := lookupBackEnd(try, view, skipHC, true, zoneRef, recursion+1, trace)
+					if moreDown && token != "CNAME" {
+						hcFound = true // Its targets are ours to fall back on; a CNAME is kept for the client to follow
+					}
+					if hcTarget != "" && !skipHC {
+						more = filterFailedAddresses(hc, hcTarget, more, recursion, trace) // Drop just the dead addresses
+					}
 
 					if len(more) > 0 {
 						// CNAME, if found locally, will be treated like EXPAND to save a round-trip to the DNS server.
@@ -525,9 +612,18 @@ func LookupBackEnd(qname string, view string, skipHC bool, zoneRef *Config, recu
 				}
 			}
 
+			if needRerun && nested {
+				trace.Add(recursion, "LookupBackEnd: all down; leaving ON-ALL-DOWN to the name asked for")
+				return nil, true
+			}
 			if needRerun {
-				trace.Add(recursion, "LookupBackEnd: Rerunning with health checks disabled")
-				returnData = LookupBackEnd(qname, view, true, zoneRef, recursion+1, trace)
+				lines, rerun := applyAllDown(qname, view, zoneRef, found, recursion, trace)
+				if rerun {
+					trace.Add(recursion, "LookupBackEnd: Rerunning with health checks disabled")
+					returnData = LookupBackEnd(qname, view, true, zoneRef, recursion+1, trace)
+				} else {
+					returnData = lines
+				}
 			}
 		}
 
@@ -537,7 +633,7 @@ func LookupBackEnd(qname string, view string, skipHC bool, zoneRef *Config, recu
 			dot := strings.IndexByte(qname, '.') // Cheaper than strings.SplintN, no malloc
 			if dot > -1 && dot < len(qname) {
 				try := "*" + qname[dot:] // no malloc, uses existing stores
-				returnData = LookupBackEnd(try, view, skipHC, zoneRef, recursion+1, trace)
+				returnData, allDown = lookupBackEnd(try, view, skipHC, nested, zoneRef, recursion+1, trace)
 			}
 		}
 	}
@@ -549,5 +645,50 @@ func LookupBackEnd(qname string, view string, skipHC bool, zoneRef *Config, recu
 	if len(returnData) > 0 {
 		CacheLookupBE.Set(QI, returnData)
 	}
-	return returnData
+	return returnData, allDown
+}
+
+// healthyHC returns true if any HC line in a zone entry is fully up (not
+// degraded), the way LookupBackEnd sees it: with operator overrides and
+// time windows, and leaving out drained targets.
+func healthyHC(lines []string) bool {
+	now := time.Now()
+	for _, line := range lines {
+		words, active := activeWords(line, now) // Lines outside their time window don't count
+		if !active || len(words) < 3 || toUpper(words[0]) != "HC" {
+			continue
+		}
+		if GetState(words[1], words[2]) == StateUp && !Drained(words[2]) {
+			return true
+		}
+	}
+	return false
+}
+
+// hcHost is the name an HC target answers with: "backend.example.com" for
+// "backend.example.com:50051", or the target as it is if it has no port.
+func hcHost(target string) string {
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
+
+// filterFailedAddresses removes the A/AAAA records of a health checked
+// target, whose individual address failed its check.  Everything else
+// (including addresses we are not tracking) passes through untouched.
+func filterFailedAddresses(hc string, target string, lines []string, recursion int, trace *LookupTrace) []string {
+	ret := make([]string, 0, len(lines))
+	for _, line := range lines {
+		words := QuotedStringToWords(line)
+		if len(words) >= 2 && (toUpper(words[0]) == "A" || toUpper(words[0]) == "AAAA") {
+			addr := words[len(words)-1]
+			if up, ok := GetAddressStatus(hc, target, addr); ok && !up {
+				trace.Addf(recursion, "HC %s %s address %s false", hc, target, addr)
+				continue
+			}
+		}
+		ret = append(ret, line)
+	}
+	return ret
 }
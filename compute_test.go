@@ -7,7 +7,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
-	//	"time"
+	"time"
 )
 
 var tableLookupBackEnd = []struct {
@@ -255,3 +255,59 @@ func BenchmarkWildard2(b *testing.B) {
 		}
 	}
 }
+
+func TestDelegateNS(t *testing.T) {
+	initGlobal("t/etc")
+	zoneRef := GlobalZoneData()
+	notrace := NewLookupTraceOff()
+
+	// Every NS goes in AUTH, and only the glue in ADD.
+	delegate := "DELEGATE unchecked.example.com ns1.unchecked.example.com ns2.unchecked.example.com"
+	found := fmt.Sprintf("%v", DelegateNS(zoneRef, "www.unchecked.example.com", "default", delegate, 0, notrace))
+	want := `{[] [unchecked.example.com. 300 NS ns1.unchecked.example.com unchecked.example.com. 300 NS ns2.unchecked.example.com] [ns1.unchecked.example.com. 300 A 192.0.2.55 ns2.unchecked.example.com. 300 AAAA 2001:db8::55] false 0}`
+	if found != want {
+		t.Errorf("DelegateNS() wanted %v found %v", want, found)
+	}
+}
+
+func TestHCPort(t *testing.T) {
+	initGlobal("t/etc")
+	waitForPoll("check_true", "one.example.com:8080")
+	waitForPoll("check_false", "two.example.com:8080")
+	ClearCaches("unit testing TestHCPort")
+	zoneRef := GlobalZoneData()
+	notrace := NewLookupTraceOff()
+
+	for target, host := range map[string]string{
+		"backend.example.com:50051": "backend.example.com",
+		"backend.example.com":       "backend.example.com",
+		"[2001:db8::1]:443":         "2001:db8::1",
+	} {
+		if found := hcHost(target); found != host {
+			t.Errorf("hcHost(%s) wanted %s found %s", target, host, found)
+		}
+	}
+
+	var tests = []struct {
+		qname string
+		out   string
+	}{
+		{"hcport.example.com", `[A 192.0.2.1]`},
+		{"hcport-down.example.com", `[A 192.0.2.2]`}, // The rerun, with health checks disabled
+	}
+	for _, tt := range tests {
+		if found := fmt.Sprintf("%s", LookupBackEnd(tt.qname, "default", false, zoneRef, 0, notrace)); found != tt.out {
+			t.Errorf("LookupBackEnd(%s) wanted %s found %s", tt.qname, tt.out, found)
+		}
+		if r := LookupFrontEndNoCache(tt.qname, "default", "A", 0, notrace); r.Rcode != 0 || len(r.Ans) != 1 {
+			t.Errorf("LookupFrontEndNoCache(%s) found %v", tt.qname, r)
+		}
+	}
+
+	// Draining the host drains every port of it.
+	defer ClearOverride("one.example.com")
+	SetOverride("one.example.com", "drain", "unit test", time.Time{})
+	if found := fmt.Sprintf("%s", LookupBackEnd("hcport.example.com", "default", false, zoneRef, 0, notrace)); found != `[]` {
+		t.Errorf("LookupBackEnd(hcport.example.com) with one.example.com drained found %s", found)
+	}
+}
@@ -107,34 +107,22 @@ func ourNewRR(s string) (dns.RR, error) {
 	return parsed, err
 }
 
+// getClientInfo finds who the answer is for: the client subnet (ecs.go), if
+// the resolver may send one, or else the resolver itself.
 func getClientInfo(w dns.ResponseWriter, r *dns.Msg) (ipString string, subnetString string, subnetSpecified bool, newSubnetOpt *dns.OPT) {
 
 	ipString = w.RemoteAddr().String() // The user is from where?. dns.go only gives us strings.
 
 	// What if .. client subnet was specified?
-	if opt := r.IsEdns0(); opt != nil {
-		for _, o := range opt.Option {
-			switch e := o.(type) {
-			case *dns.EDNS0_NSID:
-				// do stuff with e.Nsid
-			case *dns.EDNS0_SUBNET:
-				//	e.Address.String()
-				//	e.SourceNetmask
-				newSubnetOpt = new(dns.OPT)
-				newSubnetOpt.Hdr.Name = "."
-				newSubnetOpt.Hdr.Rrtype = dns.TypeOPT
-
-				newSubnet := &dns.EDNS0_SUBNET{}
-				*newSubnet = *e
-				newSubnet.SourceScope = e.SourceNetmask
-				newSubnetOpt.Option = append(newSubnetOpt.Option, e)
-				ipString = e.Address.String()
-				subnetString = fmt.Sprintf("%s/%v", ipString, e.SourceNetmask)
-				subnetSpecified = true
-				log.Printf("%s used edns0 subnet %s for %s\n", w.RemoteAddr().String(), subnetString, r.Question[0].String())
-
-			}
-		}
+	if newSubnet, lookup, ok := querySubnet(w, r); ok {
+		newSubnetOpt = new(dns.OPT)
+		newSubnetOpt.Hdr.Name = "."
+		newSubnetOpt.Hdr.Rrtype = dns.TypeOPT
+		newSubnetOpt.Option = append(newSubnetOpt.Option, newSubnet)
+		ipString = lookup
+		subnetString = fmt.Sprintf("%s/%v", lookup, newSubnet.SourceScope)
+		subnetSpecified = true
+		Debugf("%s used edns0 subnet %s for %s\n", w.RemoteAddr().String(), subnetString, r.Question[0].String())
 	}
 	if subnetString == "" {
 		if strings.Contains(ipString, ":") {
@@ -160,11 +148,17 @@ func handleGSLB(w dns.ResponseWriter, r *dns.Msg) {
 	wasLC := qname == qnameLC        // We really care about the case that people us when asking.
 
 	view := findViewOnly(ipString) // Geo + Resolver -> which data name in zone.conf
+	do := dnssecWanted(r)          // Wants signatures?
+	size := ednsSize(w, r)         // How big an answer can they take?
+	ecs := subnetOption(newSubnetOpt)
+	if ecs != nil {
+		ecsScope(ecs, ipString) // The answer holds for as much of the subnet as decided the view
+	}
 
-	QI := QueryInfo{qname: qname, view: view, qtype: qtypeStr}
+	QI := QueryInfo{qname: qname, view: view, qtype: qtypeStr, do: do, edns: r.IsEdns0() != nil, size: size}
 
 	// Hey.  Maybe we can return cached data?
-	if wasLC == true && subnetSpecified == false {
+	if wasLC == true {
 		if cached, ok := CacheMsgs.Get(QI); ok {
 			statsCache.Increment("gslb-hit")
 			j := rand.Intn(len(cached))   // We expect multiple possible results; answer one at random.
@@ -179,6 +173,9 @@ func handleGSLB(w dns.ResponseWriter, r *dns.Msg) {
 			// caller; and the remaining bytes on the cached data.
 			newLeader := []byte{uint8(r.Id >> 8), uint8(r.Id & 0xff), uint8(bits)}
 			newData := append(newLeader, cached[j].msg[3:]...)
+			if ecs != nil {
+				newData = ecsCachedReply(newData, ecs, size) // Cached for the view; the subnet is theirs
+			}
 			w.Write(newData)
 
 			// Don't forget the stats.
@@ -195,11 +192,18 @@ func handleGSLB(w dns.ResponseWriter, r *dns.Msg) {
 	if subnetSpecified {
 		m.Extra = append(m.Extra, newSubnetOpt)
 	}
+	ednsOPT(m, r)
+
+	// Zone transfers are their own thing.
+	if r.Question[0].Qclass == dns.ClassINET &&
+		(r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR) {
+		statsMsg(r)
+		handleTransfer(w, r)
+		return
+	}
 
 	// Reasons to refuse to answer, there are many.
-	if r.Question[0].Qclass != dns.ClassINET ||
-		r.Question[0].Qtype == dns.TypeAXFR ||
-		r.Question[0].Qtype == dns.TypeIXFR {
+	if r.Question[0].Qclass != dns.ClassINET {
 		statsCache.Increment("gslb-refused")
 		m.Rcode = dns.RcodeRefused
 		statsMsg(r)
@@ -250,6 +254,25 @@ func handleGSLB(w dns.ResponseWriter, r *dns.Msg) {
 	}
 	m.Rcode = stuff.Rcode
 	m.Authoritative = stuff.Aa
+	xfrSerials(m) // Secondaries see the serial of the zone they transfer
+
+	// DNSSEC: keys at the apex, proof of what is missing, and signatures.
+	zoneKeys, signed := dnssecZone(qnameLC)
+	if signed {
+		dnssecAddKeys(m, zoneKeys, qnameLC, qtype)
+	}
+	sign := signed && do
+	if sign {
+		dnssecDeny(m, zoneKeys, qnameLC, view)
+		dnssecSignAuthority(m, zoneKeys)
+	}
+
+	// Targets recovering from an outage may only get some of the answers.
+	variants := slowStartVariants(m.Answer)
+	m.Answer = variants[rand.Intn(len(variants))]
+	if sign {
+		m.Answer = append(m.Answer, signRRs(zoneKeys, m.Answer, nil)...)
+	}
 
 	if len(stuff.Ans) > 1 {
 		n := len(stuff.Ans)
@@ -269,31 +292,52 @@ func handleGSLB(w dns.ResponseWriter, r *dns.Msg) {
 	statsMsg(m)
 
 	// Finally, pack, possibly cache, and write the dns response
-	data, err := m.Pack()
+	data, err := fitResponse(m, size).Pack()
 	if err != nil {
 		// We had an error creating a DNS packet?
 		log.Printf("Error with m.Pack %v", err)
 		return
 	}
 
-	if wasLC == true && subnetSpecified == false {
+	if wasLC == true {
 		// Hey, we can cache this.
 		// No MixEdCaSE
+		ecsDetach(m)                           // Cached for the view, not the subnet
 		rcodeStr := rcodeToString(stuff.Rcode) // For stats
 
 		group := []MsgCacheRecord{} // Allocate a new set of pointers
-		group = append(group, freshMsgCacheRecord(data, rcodeStr))
-
-		// Calculate the remaining rotations
-		for i := 1; i < len(stuff.Ans); i++ { // We already did "0"
-			m.Answer = append(m.Answer[1:], m.Answer[0]) // One DNS RR rotation
-			data, err = m.Pack()                         // Re-pack the DNS data
-			if err == nil {                              // If no error..
-				group = append(group, freshMsgCacheRecord(data, rcodeStr))
+
+		// Every rotation of every variant; each variant gets the same number
+		// of entries (cycling through its rotations), so each is as likely.
+		rotations := 1
+		for _, answer := range variants {
+			if len(answer) > rotations {
+				rotations = len(answer)
+			}
+		}
+		for _, answer := range variants {
+			rotated := append([]dns.RR{}, answer...)
+			sigs := []dns.RR{}
+			if sign {
+				sigs = signRRs(zoneKeys, answer, nil) // Each variant is its own RRset
+			}
+			for i := 0; i < rotations; i++ {
+				if i > 0 && len(rotated) > 1 {
+					rotated = append(rotated[1:], rotated[0]) // One DNS RR rotation
+				}
+				m.Answer = append(append([]dns.RR{}, rotated...), sigs...)
+				fit := fitResponse(m, size) // Cut down to size, if need be
+				packed, err := fit.Pack()   // Re-pack the DNS data
+				if err == nil {             // If no error..
+					group = append(group, freshMsgCacheRecord(packed, rcodeStr))
+				}
 			}
 		}
 		statsCache.Increment("gslb-miss")
 		CacheMsgs.Set(QI, group)
+		if len(variants) > 1 {
+			slowStartRemember(QI) // Built again at the next step of the ramp
+		}
 	} else {
 		statsCache.Increment("gslb-nocache")
 	}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"strings"
+	"sync"
 
 	"github.com/miekg/dns"
 )
@@ -35,7 +36,7 @@ func initDNS() {
 	initDNSSpecialHandlers("maxmind", handleMaxMind) // Might have more than one name for specialty responders
 	initDNSSpecialHandlers("help", handleHelp)       // Might have more than one name for specialty responders
 	initDNSSpecialHandlers("break", handleBreak)     // Might have more than one name for specialty responders
-	dns.HandleFunc(".", handleGSLB)                  // Anything else, send it to the heavier weight processor.
+	dns.HandleFunc(".", ecsFormErr(handleGSLB))      // Anything else, send it to the heavier weight processor.
 }
 
 // initDNSSpecialHandlers will look in your config for a named config variable,
@@ -50,16 +51,18 @@ func initDNSSpecialHandlers(name string, handler func(dns.ResponseWriter, *dns.M
 				pattern = pattern + "."
 			}
 			Debugf("### Registering %s for handler %#v\n", pattern, handler)
-			dns.HandleFunc(pattern, handler)
+			dns.HandleFunc(pattern, ecsFormErr(handler)) // Malformed client subnets get FORMERR first (ecs.go)
 		}
 	}
 }
 
 // Start DNS services.
+// Returns once every listener is bound (any that fails to bind is fatal).
 func startDNS() {
 	initDNS()
 
 	counter := 0 // Keep a count of how many DNS servers we found.
+	var started sync.WaitGroup
 
 	c := GlobalConfig()                            // Get our config object
 	for _, proto := range []string{"udp", "tcp"} { // Checing for "tcp" and "udp"
@@ -67,7 +70,9 @@ func startDNS() {
 			counter++                    // Note how many we found
 			for _, addr := range addrs { // For every address specified
 				server := &dns.Server{Addr: addr, Net: proto} // createa a server configuration
-				go func() {                                   // And background the listener.
+				started.Add(1)
+				server.NotifyStartedFunc = started.Done
+				go func() { // And background the listener.
 					err := server.ListenAndServe()
 					if err != nil {
 						log.Fatalf("startDNS: Failed to start server.  Error: %s Parameters: %#v\n", err.Error(), server)
@@ -81,4 +86,5 @@ func startDNS() {
 	if counter == 0 {
 		log.Fatalf("StartDNS: Failed to find server for tcp or udp\n")
 	}
+	started.Wait()
 }
@@ -0,0 +1,427 @@
+package main
+
+/*
+DNSSEC online signing.
+
+Answers vary by view and by health, so they are signed as they are
+made, rather than ahead of time.  Keys are BIND-style file pairs
+(Kexample.com.+013+12345.key and .private), one pair per key, in one
+directory:
+
+[dnssec]
+keys: /etc/gslb/keys      # relative paths are relative to the config directory
+validity: 172800          # seconds a signature is good for (default 2 days)
+
+Every zone with keys there is signed.  Keys with the SEP flag (257) are
+KSKs, and sign the DNSKEY set; the others are ZSKs, and sign everything
+else.  Queries with the DO bit get RRSIGs on the answer and authority
+sections; signatures are cached, and so are the packed responses.
+
+Missing names and types are proven with "black lies": a minimally
+covering NSEC at the name asked for, whose next name is \000.NAME.  A
+missing name gets NOERROR and an NSEC listing only RRSIG and NSEC (so
+there is nothing to walk); a missing type gets an NSEC listing the types
+the name has.  Delegations get an NSEC showing NS but no DS.
+
+/gslb/dnssec/ds/ZONE prints the DS records to give to the parent
+(including those of KSKs published ahead of a rollover, and of retired
+KSKs until they are removed).  Rollovers
+themselves are in dnssec_rollover.go.
+*/
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECDefaultValidity is how long a signature is good for, if server.conf does not say.
+var DNSSECDefaultValidity = 172800
+
+// DNSSECInceptionSkew backdates signatures, for validators with slow clocks.
+var DNSSECInceptionSkew = time.Hour
+
+// CacheSigs is a cache of RRset text -> RRSIG
+var CacheSigs = NewCache_string_dnsRR("rrsig", 10000, CacheDefaultSweep)
+
+// SigningKey is one DNSSEC key, with its private half.
+type SigningKey struct {
+	Key    *dns.DNSKEY
+	Signer crypto.Signer
+	State  string // Rollover state (dnssec_rollover.go); "" or "active" keys sign, and retired KSKs
+}
+
+// ZoneKeys holds the keys of one signed zone.
+type ZoneKeys struct {
+	Zone    string // No trailing dot
+	KSK     []*SigningKey
+	ZSK     []*SigningKey
+	Standby []*SigningKey // Published, but not signing: keys on their way in or out
+}
+
+// KeyStore holds the keys of every signed zone, by zone name.
+type KeyStore map[string]*ZoneKeys
+
+// SetGlobalKeys safely sets the KeyStore (threadsafe)
+func SetGlobalKeys(k KeyStore) {
+	Global.Keys.Store(k)
+}
+
+// GlobalKeys returns the current KeyStore.
+func GlobalKeys() KeyStore {
+	if k, ok := Global.Keys.Load().(KeyStore); ok {
+		return k
+	}
+	return nil
+}
+
+// DNSKEYs returns every published key of the zone.
+func (z *ZoneKeys) DNSKEYs() []dns.RR {
+	ret := []dns.RR{}
+	for _, list := range [][]*SigningKey{z.KSK, z.ZSK, z.Standby} {
+		for _, k := range list {
+			ret = append(ret, k.Key)
+		}
+	}
+	return ret
+}
+
+// readSigningKey reads one .key file, and the .private file next to it.
+func readSigningKey(filename string) (*SigningKey, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rr, err := dns.ReadRR(f, filename)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s: not a DNSKEY", filename)
+	}
+
+	privname := strings.TrimSuffix(filename, ".key") + ".private"
+	p, err := os.Open(privname)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Close()
+	priv, err := key.ReadPrivateKey(p, privname)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: private key can't sign", privname)
+	}
+	return &SigningKey{Key: key, Signer: signer}, nil
+}
+
+// dnssecKeyDir finds the key directory from server.conf; "" if DNSSEC is off.
+func dnssecKeyDir(etc string) string {
+	dir, ok := GlobalConfig().GetSectionNameValueString("dnssec", "keys")
+	if !ok || dir == "" {
+		return ""
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(etc, dir)
+	}
+	return dir
+}
+
+// readKeyStore reads every key pair in a directory.
+func readKeyStore(dir string) (KeyStore, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "K*.key"))
+	if err != nil {
+		return nil, err
+	}
+	state, err := readRollState(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(KeyStore)
+	for _, filename := range files {
+		k, err := readSigningKey(filename)
+		if err != nil {
+			log.Printf("dnssec: %v\n", err)
+			continue
+		}
+		zone := strings.TrimSuffix(toLower(k.Key.Hdr.Name), ".")
+		if keys[zone] == nil {
+			keys[zone] = &ZoneKeys{Zone: zone}
+		}
+		if rk, ok := state[keyBaseName(filename)]; ok {
+			k.State = rk.State
+		}
+		retiredKSK := k.State == RollRetired && k.Key.Flags&dns.SEP != 0 // Signs the DNSKEY set until removed
+		if k.State != "" && k.State != RollActive && !retiredKSK {
+			keys[zone].Standby = append(keys[zone].Standby, k)
+		} else if k.Key.Flags&dns.SEP != 0 {
+			keys[zone].KSK = append(keys[zone].KSK, k)
+		} else {
+			keys[zone].ZSK = append(keys[zone].ZSK, k)
+		}
+	}
+	for zone, z := range keys {
+		if len(z.KSK) == 0 || len(z.ZSK) == 0 {
+			log.Printf("dnssec: %s needs both a KSK and a ZSK; not signing it\n", zone)
+			delete(keys, zone)
+		}
+	}
+	return keys, nil
+}
+
+// loadKeys (re)reads the DNSSEC keys named by server.conf.
+func loadKeys(etc string) {
+	dir := dnssecKeyDir(etc)
+	if dir == "" {
+		SetGlobalKeys(KeyStore{})
+		return
+	}
+	keys, err := readKeyStore(dir)
+	if err != nil {
+		log.Printf("ERROR: Failed to load DNSSEC keys from %v: %v", dir, err)
+		return
+	}
+	SetGlobalKeys(keys)
+}
+
+// dnssecZone finds the signed zone (if any) that a name belongs to.
+func dnssecZone(qname string) (*ZoneKeys, bool) {
+	keys := GlobalKeys()
+	if len(keys) == 0 {
+		return nil, false
+	}
+	name := strings.TrimSuffix(toLower(qname), ".")
+	for {
+		if z, ok := keys[name]; ok {
+			return z, true
+		}
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			return nil, false
+		}
+		name = name[dot+1:]
+	}
+}
+
+// dnssecWanted returns true if the query has the DO bit set.
+func dnssecWanted(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// dnssecValidity is how long a new signature is good for.
+func dnssecValidity() time.Duration {
+	if i, ok := GlobalConfig().GetSectionNameValueInt("dnssec", "validity"); ok && i > 0 {
+		return time.Duration(i) * time.Second
+	}
+	return time.Duration(DNSSECDefaultValidity) * time.Second
+}
+
+// rrsets groups RRs into RRsets (same name, type and class), in order of first appearance.
+func rrsets(rrs []dns.RR) [][]dns.RR {
+	index := make(map[string]int)
+	ret := [][]dns.RR{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d/%d", toLower(h.Name), h.Rrtype, h.Class)
+		if i, ok := index[key]; ok {
+			ret[i] = append(ret[i], rr)
+			continue
+		}
+		index[key] = len(ret)
+		ret = append(ret, []dns.RR{rr})
+	}
+	return ret
+}
+
+// signRRset returns an RRSIG over an RRset, from the cache if one there is still fresh.
+func signRRset(k *SigningKey, rrset []dns.RR) (*dns.RRSIG, error) {
+	text := make([]string, len(rrset))
+	for i, rr := range rrset {
+		text[i] = rr.String()
+	}
+	sort.Strings(text) // Order does not change the signature
+	cacheKey := fmt.Sprintf("%s/%d %s", k.Key.Hdr.Name, k.Key.KeyTag(), strings.Join(text, "\n"))
+
+	validity := dnssecValidity()
+	now := time.Now()
+	if cached, ok := CacheSigs.Get(cacheKey); ok {
+		sig := cached.(*dns.RRSIG)
+		if time.Unix(int64(sig.Expiration), 0).Sub(now) > validity/2 {
+			return dns.Copy(sig).(*dns.RRSIG), nil
+		}
+	}
+
+	sig := new(dns.RRSIG)
+	sig.Hdr = dns.RR_Header{Name: toLower(rrset[0].Header().Name), Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl}
+	sig.KeyTag = k.Key.KeyTag()
+	sig.SignerName = toLower(k.Key.Hdr.Name)
+	sig.Algorithm = k.Key.Algorithm
+	sig.Inception = uint32(now.Add(-DNSSECInceptionSkew).Unix())
+	sig.Expiration = uint32(now.Add(validity).Unix())
+	if err := sig.Sign(k.Signer, rrset); err != nil {
+		return nil, err
+	}
+	CacheSigs.Set(cacheKey, sig)
+	return dns.Copy(sig).(*dns.RRSIG), nil
+}
+
+// signRRs returns the RRSIGs for every RRset in a section.
+// The DNSKEY set is signed by the KSKs; everything else by the ZSKs.
+// Names outside the zone, and NS sets listed in skip, are left alone.
+func signRRs(z *ZoneKeys, rrs []dns.RR, skip map[uint16]bool) []dns.RR {
+	sigs := []dns.RR{}
+	for _, rrset := range rrsets(rrs) {
+		h := rrset[0].Header()
+		if skip[h.Rrtype] || !dns.IsSubDomain(z.Zone+".", toLower(h.Name)) {
+			continue
+		}
+		signers := z.ZSK
+		if h.Rrtype == dns.TypeDNSKEY {
+			signers = z.KSK
+		}
+		for _, k := range signers {
+			sig, err := signRRset(k, rrset)
+			if err != nil {
+				log.Printf("dnssec: signing %s %s: %v\n", h.Name, dns.TypeToString[h.Rrtype], err)
+				continue
+			}
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+// dnssecAddKeys answers DNSKEY (and ANY) queries at the apex of a signed zone.
+func dnssecAddKeys(m *dns.Msg, z *ZoneKeys, qname string, qtype uint16) {
+	if strings.TrimSuffix(toLower(qname), ".") != z.Zone || (qtype != dns.TypeDNSKEY && qtype != dns.TypeANY) {
+		return
+	}
+	for _, rr := range z.DNSKEYs() {
+		m.Answer = append(m.Answer, dns.Copy(rr))
+	}
+	m.Rcode = dns.RcodeSuccess
+	m.Authoritative = true
+	if qtype == dns.TypeDNSKEY {
+		m.Ns = []dns.RR{} // No longer a NODATA answer
+	}
+}
+
+// blackLie makes the minimally covering NSEC for a name.
+func blackLie(name string, ttl uint32, types []uint16) *dns.NSEC {
+	nsec := new(dns.NSEC)
+	nsec.Hdr = dns.RR_Header{Name: toLower(name), Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl}
+	nsec.NextDomain = "\\000." + toLower(name)
+	nsec.TypeBitMap = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	sort.Slice(nsec.TypeBitMap, func(i, j int) bool { return nsec.TypeBitMap[i] < nsec.TypeBitMap[j] })
+	return nsec
+}
+
+// negativeTTL is the TTL for denial of existence: the lesser of the SOA's TTL and minimum.
+func negativeTTL(ns []dns.RR) uint32 {
+	for _, rr := range ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return uint32(TheOneAndOnlyTTL)
+}
+
+// typesAt lists the types a name has (in a view), for a NODATA NSEC.
+func typesAt(z *ZoneKeys, qname string, view string) []uint16 {
+	seen := make(map[uint16]bool)
+	for _, s := range LookupFrontEnd(qname, view, "ANY", 0, NOTRACE).Ans {
+		words := strings.Fields(s) // name ttl type data...
+		if len(words) < 3 {
+			continue
+		}
+		if t, ok := dns.StringToType[toUpper(words[2])]; ok {
+			seen[t] = true
+		}
+	}
+	if strings.TrimSuffix(qname, ".") == z.Zone {
+		seen[dns.TypeDNSKEY] = true
+	}
+	ret := []uint16{}
+	for t := range seen {
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// dnssecDeny adds black lies to negative answers and referrals.
+func dnssecDeny(m *dns.Msg, z *ZoneKeys, qnameLC string, view string) {
+	hasSOA, referral := false, ""
+	for _, rr := range m.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA:
+			hasSOA = true
+		case dns.TypeNS:
+			if !m.Authoritative {
+				referral = rr.Header().Name
+			}
+		}
+	}
+	switch {
+	case referral != "":
+		m.Ns = append(m.Ns, blackLie(referral, negativeTTL(m.Ns), []uint16{dns.TypeNS})) // No DS here
+	case m.Rcode == dns.RcodeNameError && hasSOA:
+		m.Rcode = dns.RcodeSuccess // The name "exists", with nothing but the NSEC
+		m.Ns = append(m.Ns, blackLie(qnameLC, negativeTTL(m.Ns), nil))
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0 && hasSOA:
+		m.Ns = append(m.Ns, blackLie(qnameLC, negativeTTL(m.Ns), typesAt(z, qnameLC, view)))
+	}
+}
+
+// dnssecSignAuthority signs the authority section; child NS sets of referrals stay unsigned.
+func dnssecSignAuthority(m *dns.Msg, z *ZoneKeys) {
+	skip := map[uint16]bool{}
+	if !m.Authoritative {
+		skip[dns.TypeNS] = true
+	}
+	m.Ns = append(m.Ns, signRRs(z, m.Ns, skip)...)
+}
+
+// myHTTPDSHandler serves /gslb/dnssec/ds/ZONE
+func myHTTPDSHandler(w http.ResponseWriter, r *http.Request) {
+	zone := strings.TrimSuffix(toLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/gslb/dnssec/ds/"), "/")), ".")
+	z, ok := GlobalKeys()[zone]
+	if !ok {
+		http.Error(w, "no DNSSEC keys for "+zone, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for _, k := range append(append([]*SigningKey{}, z.KSK...), z.Standby...) {
+		if k.Key.Flags&dns.SEP == 0 {
+			continue
+		}
+		for _, digest := range []uint8{dns.SHA256} {
+			if ds := k.Key.ToDS(digest); ds != nil {
+				io.WriteString(w, ds.String()+"\n")
+			}
+		}
+	}
+}
+
+func init() {
+	http.HandleFunc("/gslb/dnssec/ds/", myHTTPDSHandler)
+}
@@ -0,0 +1,518 @@
+package main
+
+/*
+DNSSEC key rollover.
+
+With a lifetime set, keys are rolled without anyone touching them:
+
+[dnssec]
+keys: keys
+zones: example.com example.net   # zones to make keys for, if they have none
+zsk_lifetime: 2592000            # seconds a ZSK signs for (30 days); 0 never rolls
+ksk_lifetime: 31536000           # seconds a KSK signs for (1 year); 0 never rolls
+propagation: 86400               # seconds for a DNSKEY change to reach every cache
+algorithm: ECDSAP256SHA256       # for new keys
+rollover: on                     # off: never make or roll keys here (see below)
+
+A roll is a pre-publish roll:
+
+  1. propagation before the active key's lifetime is up, a new key is
+     made and published (in the DNSKEY set, not signing);
+  2. once the new key has been published for propagation, and the old
+     key's lifetime is up, the new key signs and the old key is retired
+     (still published, so signatures cached elsewhere still validate);
+     a new KSK also waits for its DS to be confirmed at the parent;
+  3. after another propagation, the old key is removed (its files are
+     moved to old/ in the key directory).
+
+For a KSK, the parent's DS records must follow: the log says which DS
+to add when a new KSK is published, and which to remove when the old one
+is removed.  A retired KSK goes on signing the DNSKEY set alongside the
+new one (a double signature) until then, so the DNSKEY set validates
+from either DS while the parent and the caches catch up.
+/gslb/dnssec/ds/ZONE lists the DS records the parent should have.
+
+Once the new DS is at the parent (and its TTL has passed), say so:
+
+  curl -X POST -H "Authorization: Bearer $TOKEN" \
+       http://localhost:8080/gslb/admin/dnssec/example.com/ds-seen
+
+Until then the new KSK stays published and the old one goes on signing,
+however long it takes.  This uses the [admin] token.
+
+Every node that runs the rollover makes and rolls keys of its own.  GSLB
+nodes answering for the same zones must share one key directory, with a
+single writer: "rollover: off" on every other node.  Those nodes make and
+change nothing; they reload the keys when the directory changes.  DS
+confirmations go to the writer.
+
+Key states are kept in rollover.json in the key directory; keys missing
+from it are taken to be active, from the time they are first seen.
+Every change reloads the keys and clears the caches.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Key states
+const (
+	RollPublished = "published" // In the DNSKEY set, waiting to sign
+	RollActive    = "active"    // Signing
+	RollRetired   = "retired"   // In the DNSKEY set, no longer signing (but a KSK still signs the DNSKEY set)
+)
+
+// RolloverStateFile is the name of the state file, in the key directory.
+var RolloverStateFile = "rollover.json"
+
+// RolloverDefaultPropagation is the propagation delay, if server.conf does not say.
+var RolloverDefaultPropagation = 86400
+
+// DNSSECKeyTTL is the TTL of the DNSKEY records we make.
+var DNSSECKeyTTL uint32 = 3600
+
+// RollKey is the rollover state of one key.
+type RollKey struct {
+	Zone  string
+	KSK   bool
+	State string
+	Since time.Time // When it entered State
+
+	DSSeen bool // A published KSK whose DS is confirmed at the parent
+}
+
+// RollState is every key's state, by key file name (without ".key").
+type RollState map[string]*RollKey
+
+// RolloverPolicy is the [dnssec] rollover settings.
+type RolloverPolicy struct {
+	Zones       []string
+	ZSKLifetime time.Duration
+	KSKLifetime time.Duration
+	Propagation time.Duration
+	Algorithm   uint8
+	Follow      bool // rollover: off; another node makes and rolls the keys
+}
+
+// rolloverPolicy reads the rollover settings from server.conf.
+func rolloverPolicy() RolloverPolicy {
+	c := GlobalConfig()
+	p := RolloverPolicy{
+		Propagation: time.Duration(RolloverDefaultPropagation) * time.Second,
+		Algorithm:   dns.ECDSAP256SHA256,
+	}
+	if s, ok := c.GetSectionNameValueString("dnssec", "zones"); ok {
+		for _, zone := range strings.Fields(s) {
+			p.Zones = append(p.Zones, strings.TrimSuffix(toLower(zone), "."))
+		}
+	}
+	if i, ok := c.GetSectionNameValueInt("dnssec", "zsk_lifetime"); ok && i > 0 {
+		p.ZSKLifetime = time.Duration(i) * time.Second
+	}
+	if i, ok := c.GetSectionNameValueInt("dnssec", "ksk_lifetime"); ok && i > 0 {
+		p.KSKLifetime = time.Duration(i) * time.Second
+	}
+	if i, ok := c.GetSectionNameValueInt("dnssec", "propagation"); ok && i > 0 {
+		p.Propagation = time.Duration(i) * time.Second
+	}
+	if s, ok := c.GetSectionNameValueString("dnssec", "algorithm"); ok {
+		if alg, ok := dns.StringToAlgorithm[toUpper(s)]; ok {
+			p.Algorithm = alg
+		} else {
+			log.Printf("dnssec: algorithm %s not understood; using %s\n", s, dns.AlgorithmToString[p.Algorithm])
+		}
+	}
+	if s, ok := c.GetSectionNameValueString("dnssec", "rollover"); ok && toLower(s) == "off" {
+		p.Follow = true
+	}
+	return p
+}
+
+// enabled is true if there is anything for the rollover task to do.
+func (p RolloverPolicy) enabled() bool {
+	return p.Follow || p.ZSKLifetime > 0 || p.KSKLifetime > 0 || len(p.Zones) > 0
+}
+
+// keyBaseName turns ".../Kexample.com.+013+12345.key" into "Kexample.com.+013+12345".
+func keyBaseName(filename string) string {
+	return strings.TrimSuffix(filepath.Base(filename), ".key")
+}
+
+// readRollState reads rollover.json; a missing file is an empty state.
+func readRollState(dir string) (RollState, error) {
+	state := make(RollState)
+	data, err := ioutil.ReadFile(filepath.Join(dir, RolloverStateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %v", RolloverStateFile, err)
+	}
+	return state, nil
+}
+
+// writeRollState writes rollover.json, by way of a temporary file.
+func writeRollState(dir string, state RollState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, RolloverStateFile)
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// keyBits is the key size to ask for, per algorithm.
+func keyBits(alg uint8) int {
+	switch alg {
+	case dns.ECDSAP384SHA384:
+		return 384
+	case dns.RSASHA256, dns.RSASHA512:
+		return 2048
+	}
+	return 256
+}
+
+// generateKey makes a new key for a zone, and writes it out BIND style.
+func generateKey(dir string, zone string, ksk bool, alg uint8) (string, *dns.DNSKEY, error) {
+	key := new(dns.DNSKEY)
+	key.Hdr = dns.RR_Header{Name: zone + ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: DNSSECKeyTTL}
+	key.Flags = dns.ZONE
+	if ksk {
+		key.Flags |= dns.SEP
+	}
+	key.Protocol = 3
+	key.Algorithm = alg
+	priv, err := key.Generate(keyBits(alg))
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := fmt.Sprintf("K%s.+%03d+%05d", zone, alg, key.KeyTag())
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".private"), []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), []byte(key.String()+"\n"), 0644); err != nil {
+		return "", nil, err
+	}
+	return name, key, nil
+}
+
+// removeKey moves a key's files to old/, out of the way of readKeyStore.
+func removeKey(dir string, name string) error {
+	old := filepath.Join(dir, "old")
+	if err := os.MkdirAll(old, 0700); err != nil {
+		return err
+	}
+	for _, ext := range []string{".key", ".private"} {
+		if err := os.Rename(filepath.Join(dir, name+ext), filepath.Join(old, name+ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// dsText is the DS record of a key, for the log.
+func dsText(key *dns.DNSKEY) string {
+	if ds := key.ToDS(dns.SHA256); ds != nil {
+		return ds.String()
+	}
+	return key.String()
+}
+
+// rollover does one pass over the keys in dir, as of now.
+// Returns what it did (one line per change), for the log.
+func rollover(dir string, p RolloverPolicy, now time.Time) (actions []string, err error) {
+	state, err := readRollState(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "K*.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Every key file, adopting any we have not seen before as active.
+	keys := make(map[string]*dns.DNSKEY)
+	zones := make(map[string]bool)
+	for _, zone := range p.Zones {
+		zones[zone] = true
+	}
+	dirty := false
+	for _, filename := range files {
+		k, err := readSigningKey(filename)
+		if err != nil {
+			log.Printf("dnssec: %v\n", err)
+			continue
+		}
+		name := keyBaseName(filename)
+		keys[name] = k.Key
+		if _, ok := state[name]; !ok {
+			zone := strings.TrimSuffix(toLower(k.Key.Hdr.Name), ".")
+			state[name] = &RollKey{Zone: zone, KSK: k.Key.Flags&dns.SEP != 0, State: RollActive, Since: now}
+			dirty = true
+		}
+	}
+	for name, rk := range state {
+		if keys[name] == nil {
+			delete(state, name) // Removed by hand
+			dirty = true
+			continue
+		}
+		zones[rk.Zone] = true
+	}
+
+	note := func(format string, args ...interface{}) {
+		actions = append(actions, fmt.Sprintf(format, args...))
+	}
+	add := func(zone string, ksk bool, st string) (*dns.DNSKEY, error) {
+		name, key, err := generateKey(dir, zone, ksk, p.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		state[name] = &RollKey{Zone: zone, KSK: ksk, State: st, Since: now}
+		keys[name] = key
+		return key, nil
+	}
+
+	sorted := []string{}
+	for zone := range zones {
+		sorted = append(sorted, zone)
+	}
+	sort.Strings(sorted)
+	for _, zone := range sorted {
+		for _, ksk := range []bool{true, false} {
+			kind, lifetime := "ZSK", p.ZSKLifetime
+			if ksk {
+				kind, lifetime = "KSK", p.KSKLifetime
+			}
+			byState := map[string][]string{}
+			for name, rk := range state {
+				if rk.Zone == zone && rk.KSK == ksk {
+					byState[rk.State] = append(byState[rk.State], name)
+				}
+			}
+			for _, list := range byState {
+				sort.Slice(list, func(i, j int) bool { return state[list[i]].Since.Before(state[list[j]].Since) })
+			}
+
+			// Retired keys go, once every cache has moved on.
+			for _, name := range byState[RollRetired] {
+				if now.Sub(state[name].Since) >= p.Propagation {
+					if err := removeKey(dir, name); err != nil {
+						return actions, err
+					}
+					delete(state, name)
+					note("%s: %s %d removed", zone, kind, keys[name].KeyTag())
+					if ksk {
+						note("%s: remove from the parent: %s", zone, dsText(keys[name]))
+					}
+				}
+			}
+
+			// A zone with no key of this kind gets one, straight away.
+			active := byState[RollActive]
+			if len(active) == 0 && len(byState[RollPublished]) == 0 {
+				key, err := add(zone, ksk, RollActive)
+				if err != nil {
+					return actions, err
+				}
+				note("%s: new %s %d active", zone, kind, key.KeyTag())
+				if ksk {
+					note("%s: add to the parent: %s", zone, dsText(key))
+				}
+				continue
+			}
+			if lifetime == 0 || len(active) == 0 {
+				continue
+			}
+			newest := active[len(active)-1]
+			due := state[newest].Since.Add(lifetime)
+
+			// Pre-publish the next key.
+			published := byState[RollPublished]
+			if len(published) == 0 && !now.Before(due.Add(-p.Propagation)) {
+				key, err := add(zone, ksk, RollPublished)
+				if err != nil {
+					return actions, err
+				}
+				note("%s: new %s %d published", zone, kind, key.KeyTag())
+				if ksk {
+					note("%s: add to the parent: %s", zone, dsText(key))
+				}
+				continue
+			}
+
+			// Swap, once the new key is everywhere (and for a KSK, its DS).
+			if len(published) > 0 && !now.Before(due) && now.Sub(state[published[0]].Since) >= p.Propagation &&
+				(!ksk || state[published[0]].DSSeen) {
+				next := published[0]
+				state[next].State, state[next].Since = RollActive, now
+				note("%s: %s %d active", zone, kind, keys[next].KeyTag())
+				for _, name := range active {
+					state[name].State, state[name].Since = RollRetired, now
+					note("%s: %s %d retired", zone, kind, keys[name].KeyTag())
+				}
+			}
+		}
+	}
+
+	if dirty || len(actions) > 0 {
+		if err := writeRollState(dir, state); err != nil {
+			return actions, err
+		}
+	}
+	return actions, nil
+}
+
+// confirmDS marks a zone's published KSKs as having their DS at the parent.
+// Returns the key tags confirmed.
+func confirmDS(dir string, zone string) (tags []uint16, err error) {
+	state, err := readRollState(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name, rk := range state {
+		if rk.Zone == zone && rk.KSK && rk.State == RollPublished {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%s: no published KSK waiting for its DS", zone)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		state[name].DSSeen = true
+		k, err := readSigningKey(filepath.Join(dir, name+".key"))
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, k.Key.KeyTag())
+	}
+	return tags, writeRollState(dir, state)
+}
+
+// keyDirStamp sums up the key files and rollover.json, to see when another node changed them.
+func keyDirStamp(dir string) string {
+	files, _ := filepath.Glob(filepath.Join(dir, "K*.key"))
+	files = append(files, filepath.Join(dir, RolloverStateFile))
+	stamp := []string{}
+	for _, filename := range files {
+		if fi, err := os.Stat(filename); err == nil {
+			stamp = append(stamp, fmt.Sprintf("%s@%d", filepath.Base(filename), fi.ModTime().UnixNano()))
+		}
+	}
+	return strings.Join(stamp, " ")
+}
+
+// rolloverLock keeps the rollover pass and DS confirmations from both writing rollover.json.
+var rolloverLock sync.Mutex
+
+// rolloverEtc is the config directory of the running rollover task, for the admin API.
+var rolloverEtc string
+
+// lastKeyStamp is the key directory as last loaded, when following another node.
+var lastKeyStamp string
+
+// rolloverOnce runs one rollover pass; if keys changed, reloads them and clears the caches.
+func rolloverOnce(etc string, now time.Time) {
+	dir := dnssecKeyDir(etc)
+	p := rolloverPolicy()
+	if dir == "" || !p.enabled() {
+		return
+	}
+	rolloverLock.Lock()
+	defer rolloverLock.Unlock()
+	if p.Follow {
+		if stamp := keyDirStamp(dir); stamp != lastKeyStamp {
+			log.Printf("dnssec: keys in %v changed; reloading\n", dir)
+			loadKeys(etc)
+			ClearCaches("DNSSEC keys changed")
+			lastKeyStamp = stamp
+		}
+		return
+	}
+	actions, err := rollover(dir, p, now)
+	for _, a := range actions {
+		log.Printf("dnssec: %s\n", a)
+	}
+	if err != nil {
+		log.Printf("ERROR: DNSSEC key rollover in %v: %v\n", dir, err)
+	}
+	if len(actions) > 0 {
+		loadKeys(etc)
+		ClearCaches("DNSSEC key rollover")
+	}
+}
+
+// taskRollover checks for key rollovers, once a minute, forever.
+func taskRollover(etc string) {
+	rolloverLock.Lock()
+	rolloverEtc = etc
+	rolloverLock.Unlock()
+	for {
+		rolloverOnce(etc, time.Now())
+		time.Sleep(time.Minute)
+	}
+}
+
+// myHTTPAdminDNSSECHandler serves POST /gslb/admin/dnssec/ZONE/ds-seen
+func myHTTPAdminDNSSECHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	words := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/gslb/admin/dnssec/"), "/"), "/")
+	if len(words) != 2 || words[0] == "" || words[1] != "ds-seen" {
+		http.Error(w, "wanted /gslb/admin/dnssec/ZONE/ds-seen", http.StatusBadRequest)
+		return
+	}
+	zone := strings.TrimSuffix(toLower(words[0]), ".")
+
+	rolloverLock.Lock()
+	etc := rolloverEtc
+	rolloverLock.Unlock()
+	dir := dnssecKeyDir(etc)
+	if etc == "" || dir == "" || rolloverPolicy().Follow {
+		http.Error(w, "keys are not rolled on this node", http.StatusConflict)
+		return
+	}
+	rolloverLock.Lock()
+	tags, err := confirmDS(dir, zone)
+	rolloverLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Printf("dnssec: %s: DS for KSK %v confirmed at the parent\n", zone, tags)
+	rolloverOnce(etc, time.Now()) // Swap now, if it is due
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, fmt.Sprintf("%s: DS for KSK %v confirmed\n", zone, tags))
+}
+
+func init() {
+	http.HandleFunc("/gslb/admin/dnssec/", myHTTPAdminDNSSECHandler)
+}
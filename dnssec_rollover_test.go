@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollover(t *testing.T) {
+	initGlobal("t/etc")
+	dir := t.TempDir()
+	day := 24 * time.Hour
+	p := RolloverPolicy{
+		Zones:       []string{"example.net"},
+		ZSKLifetime: 30 * day,
+		KSKLifetime: 60 * day,
+		Propagation: day,
+		Algorithm:   13,
+	}
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		at      time.Duration // From t0
+		dsSeen  bool          // Confirm the new KSK's DS first
+		actions []string      // What should happen, in order
+		ksk     int           // Keys afterwards: signing KSKs, signing ZSKs, and standby
+		zsk     int
+		standby int
+	}{
+		{0, false, []string{"new KSK", "add to the parent", "new ZSK"}, 1, 1, 0},
+		{time.Hour, false, nil, 1, 1, 0},
+		{29*day - time.Second, false, nil, 1, 1, 0},
+		{29 * day, false, []string{"ZSK", "published"}, 1, 1, 1},
+		{30*day - time.Second, false, nil, 1, 1, 1},
+		{30 * day, false, []string{"ZSK", "active", "ZSK", "retired"}, 1, 1, 1},
+		{31 * day, false, []string{"ZSK", "removed"}, 1, 1, 0},
+		{59 * day, false, []string{"KSK", "published", "add to the parent", "ZSK", "published"}, 1, 1, 2},
+		{60 * day, false, []string{"ZSK", "active", "ZSK", "retired"}, 1, 1, 2},          // The KSK waits for its DS
+		{90 * day, false, []string{"ZSK", "removed", "ZSK", "published"}, 1, 1, 2},       // However long it takes
+		{90*day + time.Hour, true, []string{"KSK", "active", "KSK", "retired"}, 2, 1, 1}, // Both KSKs sign
+		{91 * day, false, []string{"ZSK", "active", "ZSK", "retired"}, 2, 1, 1},
+		{91*day + time.Hour, false, []string{"KSK", "removed", "remove from the parent"}, 1, 1, 1},
+		{92 * day, false, []string{"ZSK", "removed"}, 1, 1, 0},
+	}
+	lastZSK := uint16(0)
+	for _, tt := range tests {
+		if tt.dsSeen {
+			if _, err := confirmDS(dir, "example.net"); err != nil {
+				t.Fatalf("confirmDS at %v: %v", tt.at, err)
+			}
+		}
+		actions, err := rollover(dir, p, t0.Add(tt.at))
+		if err != nil {
+			t.Fatalf("rollover at %v: %v", tt.at, err)
+		}
+		text := strings.Join(actions, "\n")
+		rest := text
+		for _, want := range tt.actions {
+			i := strings.Index(rest, want)
+			if i < 0 {
+				t.Errorf("rollover at %v: %q lacks %q (in order)", tt.at, text, want)
+				break
+			}
+			rest = rest[i+len(want):]
+		}
+		if strings.Contains(text, "remove from the parent") && !strings.Contains(text, "removed") {
+			t.Errorf("rollover at %v: %q says to remove a DS while its KSK stays", tt.at, text)
+		}
+		if len(tt.actions) == 0 && len(actions) != 0 {
+			t.Errorf("rollover at %v did %q, wanted nothing", tt.at, text)
+		}
+
+		keys, err := readKeyStore(dir)
+		if err != nil {
+			t.Fatalf("readKeyStore at %v: %v", tt.at, err)
+		}
+		z := keys["example.net"]
+		if z == nil || len(z.KSK) != tt.ksk || len(z.ZSK) != tt.zsk || len(z.Standby) != tt.standby {
+			t.Fatalf("keys at %v: %+v; wanted %v KSK, %v ZSK, %v standby", tt.at, z, tt.ksk, tt.zsk, tt.standby)
+		}
+		if sigs := signRRs(z, z.DNSKEYs(), nil); len(sigs) != tt.ksk {
+			t.Errorf("DNSKEY set at %v has %v signatures, wanted %v", tt.at, len(sigs), tt.ksk)
+		}
+		if tag := z.ZSK[0].Key.KeyTag(); tag != lastZSK && !strings.Contains(text, fmt.Sprintf("ZSK %d active", tag)) {
+			t.Errorf("rollover at %v: signing with ZSK %v after %q", tt.at, tag, text)
+		}
+		lastZSK = z.ZSK[0].Key.KeyTag()
+	}
+
+	// Removed keys are kept, out of the way.
+	if old, _ := filepath.Glob(filepath.Join(dir, "old", "K*.private")); len(old) != 4 {
+		t.Errorf("old/ has %v private keys, wanted 4", len(old))
+	}
+	if _, err := confirmDS(dir, "example.net"); err == nil {
+		t.Errorf("confirmDS with no KSK waiting did not fail")
+	}
+}
+
+func TestRolloverAdopts(t *testing.T) {
+	initGlobal("t/etc")
+	dir := t.TempDir()
+	name, key, err := generateKey(dir, "example.org", false, 13)
+	if err != nil {
+		t.Fatalf("generateKey: %v", err)
+	}
+
+	// Keys made by hand are taken as active, and nothing is rolled without a lifetime.
+	p := RolloverPolicy{Propagation: time.Hour, Algorithm: 13}
+	now := time.Now()
+	actions, err := rollover(dir, p, now)
+	if err != nil {
+		t.Fatalf("rollover: %v", err)
+	}
+	if len(actions) != 2 || !strings.Contains(actions[0], "new KSK") || !strings.Contains(actions[1], "add to the parent") {
+		t.Errorf("rollover made %q; wanted just a KSK for the ZSK made by hand", actions)
+	}
+	state, _ := readRollState(dir)
+	if rk := state[name]; rk == nil || rk.State != RollActive || !rk.Since.Equal(now) {
+		t.Errorf("%s: state %+v, wanted active since %v", name, rk, now)
+	}
+	if actions, _ := rollover(dir, p, now.Add(1000*time.Hour)); len(actions) != 0 {
+		t.Errorf("rollover with no lifetimes did %q", actions)
+	}
+	if keys, _ := readKeyStore(dir); keys["example.org"] == nil || keys["example.org"].ZSK[0].Key.KeyTag() != key.KeyTag() {
+		t.Errorf("readKeyStore lost ZSK %v", key.KeyTag())
+	}
+}
+
+func TestRolloverFollow(t *testing.T) {
+	initGlobal("t/etc")
+	etc := t.TempDir()
+	dir := filepath.Join(etc, "keys")
+	cfg := "[dnssec]\nkeys: keys\nzones: example.org\nrollover: off\n"
+	if err := os.WriteFile(filepath.Join(etc, "server.conf"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConfigFromFile(filepath.Join(etc, "server.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := GlobalConfig()
+	SetGlobalConfig(c)
+	defer SetGlobalConfig(saved)
+	defer loadKeys("t/etc")
+
+	// A follower makes no keys of its own...
+	if !rolloverPolicy().Follow {
+		t.Fatalf("rollover: off not understood")
+	}
+	rolloverOnce(etc, time.Now())
+	if files, _ := filepath.Glob(filepath.Join(dir, "K*")); len(files) != 0 {
+		t.Errorf("follower made keys: %v", files)
+	}
+
+	// ...but picks up those made by the writer.
+	for _, ksk := range []bool{true, false} {
+		if _, _, err := generateKey(dir, "example.org", ksk, 13); err != nil {
+			t.Fatalf("generateKey: %v", err)
+		}
+	}
+	rolloverOnce(etc, time.Now())
+	if z := GlobalKeys()["example.org"]; z == nil || len(z.KSK) != 1 || len(z.ZSK) != 1 {
+		t.Errorf("follower did not load the writer's key: %+v", z)
+	}
+}
+
+func TestAdminDSSeen(t *testing.T) {
+	initGlobal("t/etc")
+	etc := t.TempDir()
+	dir := filepath.Join(etc, "keys") // [dnssec] keys: keys
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	name, _, err := generateKey(dir, "example.org", true, 13)
+	if err != nil {
+		t.Fatalf("generateKey: %v", err)
+	}
+	if err := writeRollState(dir, RollState{name: {Zone: "example.org", KSK: true, State: RollPublished, Since: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	rolloverLock.Lock()
+	saved := rolloverEtc
+	rolloverEtc = etc
+	rolloverLock.Unlock()
+	defer func() {
+		rolloverLock.Lock()
+		rolloverEtc = saved
+		rolloverLock.Unlock()
+	}()
+
+	var tests = []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"POST", "/gslb/admin/dnssec/example.org/ds-seen", "wrong", 401},
+		{"GET", "/gslb/admin/dnssec/example.org/ds-seen", "unit-test-token", 405},
+		{"POST", "/gslb/admin/dnssec/example.org/bogus", "unit-test-token", 400},
+		{"POST", "/gslb/admin/dnssec/example.com/ds-seen", "unit-test-token", 404}, // Nothing waiting
+		{"POST", "/gslb/admin/dnssec/example.org./ds-seen", "unit-test-token", 200},
+		{"POST", "/gslb/admin/dnssec/example.org/ds-seen", "unit-test-token", 200}, // Again is fine
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		myHTTPAdminDNSSECHandler(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s %s: %v %q, wanted %v", tt.method, tt.path, w.Code, w.Body.String(), tt.code)
+		}
+	}
+	if state, _ := readRollState(dir); state[name] == nil || !state[name].DSSeen {
+		t.Errorf("%s: DS not confirmed in %s", name, RolloverStateFile)
+	}
+}
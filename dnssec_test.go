@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fakeDNSWriter is a dns.ResponseWriter that keeps what was written.
+type fakeDNSWriter struct {
+	remote net.Addr
+	tcp    bool
+	data   []byte   // The last message written
+	all    [][]byte // Every message written, for zone transfers
+}
+
+func (f *fakeDNSWriter) LocalAddr() net.Addr {
+	if f.tcp {
+		return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	}
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (f *fakeDNSWriter) RemoteAddr() net.Addr { return f.remote }
+func (f *fakeDNSWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	f.data = data
+	f.all = append(f.all, data)
+	return err
+}
+func (f *fakeDNSWriter) Write(b []byte) (int, error) {
+	f.data = append([]byte{}, b...)
+	f.all = append(f.all, f.data)
+	return len(b), nil
+}
+func (f *fakeDNSWriter) Close() error        { return nil }
+func (f *fakeDNSWriter) TsigStatus() error   { return nil }
+func (f *fakeDNSWriter) TsigTimersOnly(bool) {}
+func (f *fakeDNSWriter) Hijack()             {}
+func (f *fakeDNSWriter) reply() (*dns.Msg, error) {
+	m := new(dns.Msg)
+	err := m.Unpack(f.data)
+	return m, err
+}
+
+// askGSLB sends one query through handleGSLB, from 192.0.2.200.
+func askGSLB(t *testing.T, r *dns.Msg) *dns.Msg {
+	w := &fakeDNSWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 5353}}
+	handleGSLB(w, r)
+	m, err := w.reply()
+	if err != nil {
+		t.Fatalf("%s: bad reply: %v", r.Question[0].String(), err)
+	}
+	return m
+}
+
+// dnssecQuery makes a query, with the DO bit if asked.
+func dnssecQuery(qname string, qtype uint16, do bool) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(qname, qtype)
+	if do {
+		r.SetEdns0(4096, true)
+	}
+	return r
+}
+
+// verifySection checks that every RRset of a type in a section has a good signature.
+func verifySection(t *testing.T, section []dns.RR, rrtype uint16, keys []dns.RR) {
+	var sigs []*dns.RRSIG
+	var rrset []dns.RR
+	for _, rr := range section {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == rrtype {
+			sigs = append(sigs, sig)
+		} else if rr.Header().Rrtype == rrtype {
+			rrset = append(rrset, rr)
+		}
+	}
+	if len(rrset) == 0 || len(sigs) == 0 {
+		t.Fatalf("no signed %s RRset in %v", dns.TypeToString[rrtype], section)
+	}
+	for _, sig := range sigs {
+		verified := false
+		for _, rr := range keys {
+			if key := rr.(*dns.DNSKEY); key.KeyTag() == sig.KeyTag {
+				if err := sig.Verify(key, rrset); err != nil {
+					t.Errorf("RRSIG over %s does not verify: %v", dns.TypeToString[rrtype], err)
+				}
+				verified = true
+			}
+		}
+		if !verified {
+			t.Errorf("RRSIG over %s by unknown key %v", dns.TypeToString[rrtype], sig.KeyTag)
+		}
+	}
+}
+
+func TestDNSSECSigning(t *testing.T) {
+	initGlobal("t/etc")
+	z, ok := dnssecZone("www.a.example.com.")
+	if !ok || z.Zone != "example.com" || len(z.KSK) != 1 || len(z.ZSK) != 1 {
+		t.Fatalf("dnssecZone(www.a.example.com) = %+v %v; wanted the example.com keys", z, ok)
+	}
+	keys := z.DNSKEYs()
+
+	// Signed answers, twice: made, then from the packed response cache.
+	for i := 0; i < 2; i++ {
+		m := askGSLB(t, dnssecQuery("a.example.com.", dns.TypeA, true))
+		verifySection(t, m.Answer, dns.TypeA, keys)
+		if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+			t.Errorf("reply to a DO query has no OPT with DO")
+		}
+	}
+
+	// No DO, no signatures.
+	for _, rr := range askGSLB(t, dnssecQuery("a.example.com.", dns.TypeA, false)).Answer {
+		if rr.Header().Rrtype == dns.TypeRRSIG {
+			t.Errorf("RRSIG without the DO bit: %v", rr)
+		}
+	}
+
+	// The keys themselves, signed by the KSK.
+	m := askGSLB(t, dnssecQuery("example.com.", dns.TypeDNSKEY, true))
+	verifySection(t, m.Answer, dns.TypeDNSKEY, keys)
+	for _, rr := range m.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.KeyTag != z.KSK[0].Key.KeyTag() {
+			t.Errorf("DNSKEY set signed by %v, wanted the KSK", sig.KeyTag)
+		}
+	}
+}
+
+func TestDNSSECDenial(t *testing.T) {
+	initGlobal("t/etc")
+	z, _ := dnssecZone("example.com.")
+	keys := z.DNSKEYs()
+
+	var tests = []struct {
+		qname string
+		qtype uint16
+		has   []uint16
+		lacks []uint16
+	}{
+		{"dne.example.com.", dns.TypeA, []uint16{dns.TypeRRSIG, dns.TypeNSEC}, []uint16{dns.TypeA}},  // NXDOMAIN
+		{"a.example.com.", dns.TypeAAAA, []uint16{dns.TypeA, dns.TypeRRSIG}, []uint16{dns.TypeAAAA}}, // NODATA
+	}
+	for _, tt := range tests {
+		m := askGSLB(t, dnssecQuery(tt.qname, tt.qtype, true))
+		if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+			t.Errorf("%s: rcode %v with %v answers; wanted an empty NOERROR", tt.qname, rcodeToString(m.Rcode), len(m.Answer))
+		}
+		verifySection(t, m.Ns, dns.TypeSOA, keys)
+		verifySection(t, m.Ns, dns.TypeNSEC, keys)
+		for _, rr := range m.Ns {
+			nsec, ok := rr.(*dns.NSEC)
+			if !ok {
+				continue
+			}
+			if nsec.Hdr.Name != tt.qname || nsec.NextDomain != "\\000."+tt.qname {
+				t.Errorf("%s: NSEC %v is not a minimal cover", tt.qname, nsec)
+			}
+			types := map[uint16]bool{}
+			for _, t := range nsec.TypeBitMap {
+				types[t] = true
+			}
+			for _, want := range tt.has {
+				if !types[want] {
+					t.Errorf("%s: NSEC %v lacks %s", tt.qname, nsec, dns.TypeToString[want])
+				}
+			}
+			for _, unwanted := range tt.lacks {
+				if types[unwanted] {
+					t.Errorf("%s: NSEC %v has %s", tt.qname, nsec, dns.TypeToString[unwanted])
+				}
+			}
+		}
+	}
+
+	// Without DO, NXDOMAIN stays NXDOMAIN.
+	if m := askGSLB(t, dnssecQuery("dne.example.com.", dns.TypeA, false)); m.Rcode != dns.RcodeNameError {
+		t.Errorf("dne.example.com without DO: rcode %v, wanted NXDOMAIN", rcodeToString(m.Rcode))
+	}
+}
+
+func TestDNSSECDS(t *testing.T) {
+	initGlobal("t/etc")
+	z, _ := dnssecZone("example.com.")
+
+	w := httptest.NewRecorder()
+	myHTTPDSHandler(w, httptest.NewRequest("GET", "/gslb/dnssec/ds/example.com", nil))
+	want := z.KSK[0].Key.ToDS(dns.SHA256).String()
+	if body := w.Body.String(); !strings.Contains(body, want) {
+		t.Errorf("/gslb/dnssec/ds/example.com = %q, wanted %q", body, want)
+	}
+
+	w = httptest.NewRecorder()
+	myHTTPDSHandler(w, httptest.NewRequest("GET", "/gslb/dnssec/ds/example.org", nil))
+	if w.Code != 404 {
+		t.Errorf("/gslb/dnssec/ds/example.org returned %v, wanted 404", w.Code)
+	}
+}
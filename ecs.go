@@ -0,0 +1,208 @@
+package main
+
+/*
+EDNS Client Subnet (RFC 7871).
+
+ECS is only used from resolvers we trust to send it:
+
+[ecs]
+allow: [192.0.2.2, 198.51.100.0/24, 2001:db8::/32]   # resolvers (IPs or CIDRs)
+max_source4: 24   # use no more than this much of an IPv4 client subnet (default 24)
+max_source6: 56   # likewise for IPv6 (default 56)
+
+From anyone else, the option is ignored, and the reply has none.
+
+A malformed option gets FORMERR, from anyone (RFC 7871 7.1.1): a
+nonzero scope prefix in the query, a family other than IPv4 (1) and
+IPv6 (2), or a source prefix longer than the family's address.
+
+The reply echoes the family, source prefix and address of the query.
+Its scope is how much of the address decided the answer: the longer of
+the GeoIP networks (ISP and country) the address is in, or all of it
+for a "resolver:" line match - but never more than was used, after
+max_source4/max_source6.  Without GeoIP data, the scope is what was used.
+
+Answers only depend on the view, so replies to ECS queries come from the
+same cache as everyone else's (keyed by view), with the option added.
+*/
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ECSDefaultMaxSource4 and ECSDefaultMaxSource6 are the most of a client subnet we use.
+var ECSDefaultMaxSource4 = 24
+var ECSDefaultMaxSource6 = 56
+
+var statsECS = newStat("ecs")
+
+// ecsAllowed returns true if a resolver's client subnets are to be used.
+func ecsAllowed(remote net.Addr) bool {
+	list, _ := GlobalConfig().GetSectionNameValueStrings("ecs", "allow")
+	return addrAllowed(remoteIP(remote), list)
+}
+
+// ecsMaxSource is the most of a client subnet we use, per family.
+func ecsMaxSource(family uint16) int {
+	if family == 1 {
+		if i, ok := GlobalConfig().GetSectionNameValueInt("ecs", "max_source4"); ok && i >= 0 && i <= 32 {
+			return i
+		}
+		return ECSDefaultMaxSource4
+	}
+	if i, ok := GlobalConfig().GetSectionNameValueInt("ecs", "max_source6"); ok && i >= 0 && i <= 128 {
+		return i
+	}
+	return ECSDefaultMaxSource6
+}
+
+// ecsBits is the address length of each ECS family.
+var ecsBits = map[uint16]int{1: 32, 2: 128}
+
+// ecsMalformed returns true if a query's client subnet breaks RFC 7871 7.1.1.
+func ecsMalformed(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if e, isSubnet := o.(*dns.EDNS0_SUBNET); isSubnet {
+			bits := ecsBits[e.Family]
+			return bits == 0 || int(e.SourceNetmask) > bits || e.SourceScope != 0
+		}
+	}
+	return false
+}
+
+// ecsFormErr wraps a DNS handler, answering FORMERR to queries with a malformed client subnet.
+func ecsFormErr(handler func(dns.ResponseWriter, *dns.Msg)) func(dns.ResponseWriter, *dns.Msg) {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if !ecsMalformed(r) {
+			handler(w, r)
+			return
+		}
+		statsECS.Increment("invalid")
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		ednsOPT(m, r)
+		statsMsg(r)
+		statsMsg(m)
+		w.WriteMsg(m)
+	}
+}
+
+// querySubnet vets the client subnet of a query.  It returns the option
+// for the reply (a copy, whose scope is what we used of the subnet),
+// and the address to look up in its place.
+func querySubnet(w dns.ResponseWriter, r *dns.Msg) (reply *dns.EDNS0_SUBNET, lookup string, ok bool) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil, "", false
+	}
+	for _, o := range opt.Option {
+		e, isSubnet := o.(*dns.EDNS0_SUBNET)
+		if !isSubnet {
+			continue
+		}
+		if ecsMalformed(r) {
+			return nil, "", false // ecsFormErr has answered it
+		}
+		bits := ecsBits[e.Family]
+		if !ecsAllowed(w.RemoteAddr()) {
+			statsECS.Increment("ignored")
+			return nil, "", false
+		}
+		statsECS.Increment("used")
+
+		reply = &dns.EDNS0_SUBNET{}
+		*reply = *e
+		used := int(e.SourceNetmask)
+		if max := ecsMaxSource(e.Family); used > max {
+			used = max
+			statsECS.Increment("truncated")
+		}
+		reply.SourceScope = uint8(used)
+		if used == 0 {
+			return reply, parseIpOnly(w.RemoteAddr().String()), true // Nothing to go on but the resolver
+		}
+		return reply, e.Address.Mask(net.CIDRMask(used, bits)).String(), true
+	}
+	return nil, "", false
+}
+
+// subnetOption finds the client subnet in an OPT record made by getClientInfo.
+func subnetOption(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+// viewScope is how much of an address decided its view: the longer of the
+// GeoIP networks it is in, or all of it for a "resolver:" line.
+func viewScope(ipString string) (scope int, known bool) {
+	bits := 128
+	if ip := net.ParseIP(ipString); ip != nil && ip.To4() != nil {
+		bits = 32
+	}
+	if _, ok := GlobalViewData().GetSectionNameValueString(DEFAULT, ipString); ok {
+		return bits, true
+	}
+	scope = -1
+	for _, m := range []*GeoIP2{GlobalGeoIP2ISP(), GlobalGeoIP2Country()} {
+		if network, ok := m.Network(ipString); ok {
+			if ones, _ := network.Mask.Size(); ones > scope {
+				scope = ones
+			}
+		}
+	}
+	return scope, scope >= 0
+}
+
+// ecsScope narrows the scope of a reply's client subnet to what decided the view.
+func ecsScope(e *dns.EDNS0_SUBNET, ipString string) {
+	if scope, known := viewScope(ipString); known && scope < int(e.SourceScope) {
+		e.SourceScope = uint8(scope)
+	}
+}
+
+// ecsDetach takes the client subnet out of a reply, leaving the rest of its OPT.
+func ecsDetach(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	kept := []dns.EDNS0{}
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+}
+
+// ecsCachedReply adds a client subnet to a cached (packed) reply.
+func ecsCachedReply(data []byte, e *dns.EDNS0_SUBNET, size int) []byte {
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		return data
+	}
+	m.Compress = true
+	opt := m.IsEdns0()
+	if opt == nil {
+		return data
+	}
+	opt.Option = append(opt.Option, e)
+	packed, err := fitResponse(m, size).Pack()
+	if err != nil {
+		return data
+	}
+	return packed
+}
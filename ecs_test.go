@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// ecsQuery makes a query with a client subnet.
+func ecsQuery(qname string, qtype uint16, subnet string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(qname, qtype)
+	r.SetEdns0(1232, false)
+	ip, network, _ := net.ParseCIDR(subnet)
+	ones, _ := network.Mask.Size()
+	e := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ip}
+	if ip.To4() == nil {
+		e.Family = 2
+	}
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, e)
+	return r
+}
+
+func TestQuerySubnet(t *testing.T) {
+	initGlobal("t/etc")
+
+	var tests = []struct {
+		remote string
+		subnet string
+		ok     bool
+		lookup string
+		scope  uint8
+	}{
+		{"192.0.2.200", "192.0.2.1/32", true, "192.0.2.1", 32},
+		{"192.0.2.200", "198.51.100.7/24", true, "198.51.100.0", 24},
+		{"192.0.2.200", "2001:db8::1/128", true, "2001:db8::", 56}, // max_source6
+		{"2001:db8::53", "198.51.100.7/24", true, "198.51.100.0", 24},
+		{"192.0.2.200", "198.51.100.7/0", true, "192.0.2.200", 0}, // The resolver asks us not to look
+		{"198.51.100.1", "192.0.2.1/32", false, "", 0},            // Not on the allow list
+	}
+	for _, tt := range tests {
+		w := &fakeDNSWriter{remote: &net.UDPAddr{IP: net.ParseIP(tt.remote), Port: 5353}}
+		reply, lookup, ok := querySubnet(w, ecsQuery("a.example.com.", dns.TypeA, tt.subnet))
+		if ok != tt.ok || lookup != tt.lookup || (ok && reply.SourceScope != tt.scope) {
+			t.Errorf("querySubnet(%s from %s) = %v %q %+v; wanted %v %q scope %v", tt.subnet, tt.remote, ok, lookup, reply, tt.ok, tt.lookup, tt.scope)
+		}
+	}
+
+	// A scope in the query, or a prefix too long for the family, is not ECS we can use.
+	r := ecsQuery("a.example.com.", dns.TypeA, "192.0.2.1/32")
+	r.IsEdns0().Option[0].(*dns.EDNS0_SUBNET).SourceNetmask = 33
+	w := &fakeDNSWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 5353}}
+	if _, _, ok := querySubnet(w, r); ok {
+		t.Errorf("querySubnet accepted a /33")
+	}
+}
+
+func TestECSFormErr(t *testing.T) {
+	initGlobal("t/etc")
+
+	var tests = []struct {
+		remote  string
+		subnet  string
+		change  func(e *dns.EDNS0_SUBNET)
+		formerr bool
+	}{
+		{"192.0.2.200", "192.0.2.1/32", func(e *dns.EDNS0_SUBNET) {}, false},
+		{"192.0.2.200", "192.0.2.1/32", func(e *dns.EDNS0_SUBNET) { e.SourceScope = 24 }, true},
+		{"192.0.2.200", "192.0.2.1/32", func(e *dns.EDNS0_SUBNET) { e.Family = 3 }, true},
+		{"192.0.2.200", "192.0.2.1/32", func(e *dns.EDNS0_SUBNET) { e.SourceNetmask = 33 }, true},
+		{"192.0.2.200", "2001:db8::1/128", func(e *dns.EDNS0_SUBNET) { e.SourceNetmask = 129 }, true},
+		{"198.51.100.1", "192.0.2.1/32", func(e *dns.EDNS0_SUBNET) { e.SourceScope = 24 }, true}, // Not on the allow list: still malformed
+	}
+	for _, tt := range tests {
+		r := ecsQuery("example.", dns.TypeTXT, tt.subnet)
+		e := r.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+		tt.change(e)
+		w := &fakeDNSWriter{remote: &net.UDPAddr{IP: net.ParseIP(tt.remote), Port: 5353}}
+		ecsFormErr(handleGSLB)(w, r)
+		m, err := w.reply()
+		if err != nil {
+			t.Fatalf("%+v from %s: %v", e, tt.remote, err)
+		}
+		if formerr := m.Rcode == dns.RcodeFormatError; formerr != tt.formerr {
+			t.Errorf("%+v from %s: rcode %v, wanted FORMERR %v", e, tt.remote, rcodeToString(m.Rcode), tt.formerr)
+		}
+		if tt.formerr && (m.IsEdns0() == nil || len(m.Answer) != 0) {
+			t.Errorf("%+v from %s: FORMERR wanted with an OPT and no answer: %v", e, tt.remote, m)
+		}
+	}
+}
+
+func TestECSReplies(t *testing.T) {
+	initGlobal("t/etc")
+	ClearCaches("unit testing TestECSReplies")
+
+	var tests = []struct {
+		remote string
+		subnet string
+		txt    string // Which view answered
+		scope  int    // -1: no ECS in the reply
+	}{
+		{"192.0.2.200", "192.0.2.1/32", "comcast", 32}, // A resolver: line decides it all
+		{"192.0.2.200", "198.51.100.7/24", "default", 24},
+		{"192.0.2.200", "192.0.2.1/32", "comcast", 32},  // Again, from the cache
+		{"198.51.100.1", "192.0.2.1/32", "default", -1}, // Not allowed: ignored
+	}
+	for _, tt := range tests {
+		w := &fakeDNSWriter{remote: &net.UDPAddr{IP: net.ParseIP(tt.remote), Port: 5353}}
+		r := ecsQuery("example.", dns.TypeTXT, tt.subnet)
+		handleGSLB(w, r)
+		m, err := w.reply()
+		if err != nil {
+			t.Fatalf("%s from %s: bad reply: %v", tt.subnet, tt.remote, err)
+		}
+		if len(m.Answer) != 1 || !strings.Contains(m.Answer[0].String(), tt.txt) {
+			t.Errorf("%s from %s: answer %v, wanted %s", tt.subnet, tt.remote, m.Answer, tt.txt)
+		}
+
+		var e *dns.EDNS0_SUBNET
+		if opt := m.IsEdns0(); opt != nil {
+			e = subnetOption(opt)
+		}
+		if tt.scope < 0 {
+			if e != nil {
+				t.Errorf("%s from %s: reply has ECS %v", tt.subnet, tt.remote, e)
+			}
+			continue
+		}
+		asked := r.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+		_, network, _ := net.ParseCIDR(tt.subnet) // On the wire, bits past the source prefix are zero
+		if e == nil || e.Family != asked.Family || e.SourceNetmask != asked.SourceNetmask || !e.Address.Equal(network.IP) || int(e.SourceScope) != tt.scope {
+			t.Errorf("%s from %s: reply ECS %v, wanted %v with scope %v", tt.subnet, tt.remote, e, asked, tt.scope)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+/*
+EDNS0 message sizes.
+
+UDP answers are kept to what the client says it can take (the UDP
+payload size in its OPT record, or 512 bytes without one), capped by:
+
+[server]
+edns_max: 1232     # the largest UDP answer we will send (default 1232)
+
+An answer that is too big first loses its additional section (glue); if
+it is still too big, it goes out empty with TC set, and the client asks
+again over TCP.  Replies to EDNS0 queries carry an OPT record with our
+own size (and the DO bit, if it was asked for).
+
+Sizes are rounded down to a few size classes, and packed answers are
+cached per class, so a small client never gets an answer packed for a
+big one.  The edns stats count answers that lost glue or were truncated.
+*/
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDNSDefaultMax is the largest UDP answer we send, if server.conf does not say.
+var EDNSDefaultMax = 1232
+
+// ednsSizeClasses are the sizes answers are packed for (besides edns_max, and TCP).
+var ednsSizeClasses = []int{dns.MinMsgSize, 1232, 1452, 4096}
+
+var statsEDNS = newStat("edns")
+
+// ednsMax is the largest UDP answer we will send.
+func ednsMax() int {
+	if i, ok := GlobalConfig().GetSectionNameValueInt("server", "edns_max"); ok && i > 0 {
+		if i < dns.MinMsgSize {
+			return dns.MinMsgSize
+		}
+		if i > dns.MaxMsgSize {
+			return dns.MaxMsgSize
+		}
+		return i
+	}
+	return EDNSDefaultMax
+}
+
+// ednsSize is the most a reply to r may take: the client's size, capped by
+// ednsMax, and rounded down to a size class.  TCP replies may take up to 64k.
+func ednsSize(w dns.ResponseWriter, r *dns.Msg) int {
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		return dns.MaxMsgSize
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	size, max := int(opt.UDPSize()), ednsMax()
+	if size >= max {
+		return max
+	}
+	class := dns.MinMsgSize
+	for _, c := range ednsSizeClasses {
+		if c <= size {
+			class = c
+		}
+	}
+	return class
+}
+
+// ednsOPT gives the reply to an EDNS0 query an OPT record of its own,
+// reusing one already there (such as for client subnet).
+func ednsOPT(m *dns.Msg, r *dns.Msg) {
+	ropt := r.IsEdns0()
+	if ropt == nil {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		m.Extra = append(m.Extra, opt)
+	}
+	opt.SetUDPSize(uint16(ednsMax()))
+	if ropt.Do() {
+		opt.SetDo()
+	}
+}
+
+// fitResponse returns m if it fits in size bytes; otherwise a copy without
+// glue, or failing that, an empty copy with TC set.  m itself is not changed.
+func fitResponse(m *dns.Msg, size int) *dns.Msg {
+	if m.Len() <= size {
+		return m
+	}
+	fit := *m
+	fit.Extra = nil
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			fit.Extra = append(fit.Extra, rr) // Always keep the OPT
+		}
+	}
+	if fit.Len() <= size {
+		statsEDNS.Increment("glue-dropped")
+		return &fit
+	}
+	fit.Truncated = true
+	fit.Answer = nil
+	fit.Ns = nil
+	statsEDNS.Increment("truncated")
+	return &fit
+}
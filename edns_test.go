@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEDNSSize(t *testing.T) {
+	initGlobal("t/etc")
+
+	var tests = []struct {
+		tcp  bool
+		udp  uint16 // 0: no EDNS0
+		want int
+	}{
+		{false, 0, 512},
+		{false, 512, 512},
+		{false, 600, 512},
+		{false, 1232, 1232},
+		{false, 1300, 1232},
+		{false, 4096, 1232}, // Capped by edns_max
+		{true, 0, 65535},
+		{true, 4096, 65535},
+	}
+	for _, tt := range tests {
+		w := &fakeDNSWriter{tcp: tt.tcp, remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 5353}}
+		if tt.tcp {
+			w.remote = &net.TCPAddr{IP: net.ParseIP("192.0.2.200"), Port: 5353}
+		}
+		r := new(dns.Msg)
+		r.SetQuestion("a.example.com.", dns.TypeA)
+		if tt.udp > 0 {
+			r.SetEdns0(tt.udp, false)
+		}
+		if found := ednsSize(w, r); found != tt.want {
+			t.Errorf("ednsSize(tcp=%v, udp=%v) = %v, wanted %v", tt.tcp, tt.udp, found, tt.want)
+		}
+	}
+}
+
+func TestFitResponse(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.Compress = true
+	for _, s := range []string{"www.example.com. 300 A 192.0.2.1", "www.example.com. 300 A 192.0.2.2"} {
+		rr, _ := dns.NewRR(s)
+		m.Answer = append(m.Answer, rr)
+	}
+	ns, _ := dns.NewRR("example.com. 300 NS ns1.example.com.")
+	m.Ns = append(m.Ns, ns)
+	for _, s := range []string{"ns1.example.com. 300 A 192.0.2.254", "ns1.example.com. 300 AAAA 2001:db8::254"} {
+		rr, _ := dns.NewRR(s)
+		m.Extra = append(m.Extra, rr)
+	}
+	m.SetEdns0(1232, false)
+
+	noGlue := m.Copy()
+	noGlue.Extra = noGlue.Extra[2:]
+	size := noGlue.Len()
+
+	var tests = []struct {
+		size   int
+		answer int
+		extra  int // Including the OPT
+		tc     bool
+	}{
+		{m.Len(), 2, 3, false},
+		{m.Len() - 1, 2, 1, false}, // Glue goes first
+		{size, 2, 1, false},
+		{size - 1, 0, 1, true},
+	}
+	for _, tt := range tests {
+		fit := fitResponse(m, tt.size)
+		if len(fit.Answer) != tt.answer || len(fit.Extra) != tt.extra || fit.Truncated != tt.tc {
+			t.Errorf("fitResponse(%v): %v answers, %v extra, TC %v; wanted %v, %v, %v", tt.size, len(fit.Answer), len(fit.Extra), fit.Truncated, tt.answer, tt.extra, tt.tc)
+		}
+		if fit.Len() > tt.size {
+			t.Errorf("fitResponse(%v) is %v bytes", tt.size, fit.Len())
+		}
+		if fit.IsEdns0() == nil {
+			t.Errorf("fitResponse(%v) lost the OPT", tt.size)
+		}
+	}
+	if len(m.Answer) != 2 || len(m.Extra) != 3 || m.Truncated {
+		t.Errorf("fitResponse changed the original message")
+	}
+}
+
+func TestEDNSTruncation(t *testing.T) {
+	initGlobal("t/etc")
+	ClearCaches("unit testing TestEDNSTruncation")
+
+	var tests = []struct {
+		udp     uint16 // 0: no EDNS0
+		answers int
+		tc      bool
+	}{
+		{0, 0, true},
+		{4096, 40, false},
+		{0, 0, true}, // Not the 4096 byte answer, from the cache
+		{1232, 40, false},
+		{600, 0, true},
+	}
+	for _, tt := range tests {
+		r := new(dns.Msg)
+		r.SetQuestion("big.example.com.", dns.TypeA)
+		if tt.udp > 0 {
+			r.SetEdns0(tt.udp, false)
+		}
+		m := askGSLB(t, r)
+		if len(m.Answer) != tt.answers || m.Truncated != tt.tc {
+			t.Errorf("big.example.com (udp %v): %v answers, TC %v; wanted %v, %v", tt.udp, len(m.Answer), m.Truncated, tt.answers, tt.tc)
+		}
+		opt := m.IsEdns0()
+		if (opt != nil) != (tt.udp > 0) {
+			t.Errorf("big.example.com (udp %v): OPT in reply is %v", tt.udp, opt)
+		}
+		if opt != nil && int(opt.UDPSize()) != ednsMax() {
+			t.Errorf("big.example.com (udp %v): OPT says %v, wanted %v", tt.udp, opt.UDPSize(), ednsMax())
+		}
+	}
+
+	// TCP gets it all.
+	r := new(dns.Msg)
+	r.SetQuestion("big.example.com.", dns.TypeA)
+	w := &fakeDNSWriter{tcp: true, remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.200"), Port: 5353}}
+	handleGSLB(w, r)
+	if m, err := w.reply(); err != nil || len(m.Answer) != 40 || m.Truncated {
+		t.Errorf("big.example.com over TCP: %v %v", m, err)
+	}
+}
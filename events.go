@@ -0,0 +1,188 @@
+package main
+
+/*
+Event stream.
+
+/gslb/events is a server-sent event (text/event-stream) feed, for
+dashboards and bots that want to react as things happen:
+
+  health  a health check changed state (up, degraded, down)
+  pool    every health checked target of a name failed (see notify.go)
+  reload  the configuration files were reloaded
+  cache   the caches were cleared, and why
+  route   a watched name started answering differently, in some view
+
+  curl -N http://localhost:8080/gslb/events
+  curl -N http://localhost:8080/gslb/events?kind=health,route
+
+Names to watch for routing changes are listed in server.conf:
+
+[events]
+watch: [www.test-ipv6.com, ds.test-ipv6.com]
+
+Their A and AAAA answers are compared, for every view, each time the
+caches are cleared.
+
+Slow listeners miss events rather than hold anyone up.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventBuffer is how many events a listener may fall behind, before it misses some.
+var EventBuffer = 100
+
+var eventsLock sync.Mutex
+var eventsListeners = make(map[chan Event]bool)
+
+// Subscribe returns a channel of every event published from now on.
+// Call Unsubscribe when done.
+func Subscribe() chan Event {
+	ch := make(chan Event, EventBuffer)
+	eventsLock.Lock()
+	eventsListeners[ch] = true
+	eventsLock.Unlock()
+	return ch
+}
+
+// Unsubscribe stops sending events to a channel from Subscribe.
+func Unsubscribe(ch chan Event) {
+	eventsLock.Lock()
+	delete(eventsListeners, ch)
+	eventsLock.Unlock()
+}
+
+// Publish sends an event to every listener of /gslb/events.
+func Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	statsEvents.Increment(e.Kind)
+	eventsLock.Lock()
+	for ch := range eventsListeners {
+		select {
+		case ch <- e:
+		default:
+			statsEvents.Increment("dropped") // Slow listener
+		}
+	}
+	eventsLock.Unlock()
+}
+
+// routeTrigger asks taskWatchRoutes for another look; one pending request is enough.
+var routeTrigger = make(chan bool, 1)
+
+// triggerWatchRoutes asks for the watched names to be looked up again, soon.
+func triggerWatchRoutes() {
+	select {
+	case routeTrigger <- true:
+	default:
+	}
+}
+
+// RouteKey identifies one answer set of a watched name.
+type RouteKey struct {
+	qname string
+	view  string
+	qtype string
+}
+
+// watchedRoutes looks up the current answers for every watched name, in every view.
+func watchedRoutes() map[RouteKey]string {
+	names, ok := GlobalConfig().GetSectionNameValueStrings("events", "watch")
+	if !ok {
+		return nil
+	}
+	z := GlobalZoneData()
+	views := map[string]bool{DEFAULT: true}
+	for key := range z.Data {
+		views[key.Section] = true
+	}
+
+	routes := make(map[RouteKey]string)
+	for _, name := range names {
+		for view := range views {
+			for _, qtype := range []string{"A", "AAAA"} {
+				ans := append([]string{}, LookupFrontEnd(toLower(name), view, qtype, 0, NOTRACE).Ans...)
+				sort.Strings(ans) // Order is not a routing change
+				routes[RouteKey{toLower(name), view, qtype}] = strings.Join(ans, "; ")
+			}
+		}
+	}
+	return routes
+}
+
+// diffRoutes publishes a "route" event for every answer set that changed.
+func diffRoutes(old map[RouteKey]string, routes map[RouteKey]string) {
+	for key, now := range routes {
+		if was, ok := old[key]; ok && was != now {
+			Publish(Event{Kind: "route", Target: key.qname, View: key.view, Qtype: key.qtype, Old: was, New: now})
+		}
+	}
+}
+
+// taskWatchRoutes looks for routing changes of watched names, after every cache clear.
+func taskWatchRoutes() {
+	routes := watchedRoutes()
+	for range routeTrigger {
+		latest := watchedRoutes()
+		diffRoutes(routes, latest)
+		routes = latest
+	}
+}
+
+// myHTTPEventsHandler serves /gslb/events
+func myHTTPEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	kinds := map[string]bool{}
+	for _, kind := range strings.Split(r.URL.Query().Get("kind"), ",") {
+		if kind != "" {
+			kinds[kind] = true
+		}
+	}
+
+	ch := Subscribe()
+	defer Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, ": gslb events\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(time.Duration(30) * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+		case e := <-ch:
+			if len(kinds) > 0 && !kinds[e.Kind] {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			io.WriteString(w, fmt.Sprintf("event: %s\ndata: %s\n\n", e.Kind, data))
+		}
+		flusher.Flush()
+	}
+}
+
+func init() {
+	http.HandleFunc("/gslb/events", myHTTPEventsHandler)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForEvent reads events until one matches, or a second passes.
+func waitForEvent(ch chan Event, match func(Event) bool) (Event, bool) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-ch:
+			if match(e) {
+				return e, true
+			}
+		case <-timeout:
+			return Event{}, false
+		}
+	}
+}
+
+func TestEventsRoutes(t *testing.T) {
+	initGlobal("t/etc")
+	waitForPoll("check_true", "one.example.com")
+	waitForPoll("check_true", "two.example.com")
+	ch := Subscribe()
+	defer Unsubscribe(ch)
+	defer ClearOverride("one.example.com")
+
+	ClearCaches("unit testing TestEventsRoutes")
+	before := watchedRoutes()
+	if found := before[RouteKey{"drain.example.com", DEFAULT, "A"}]; !strings.Contains(found, "192.0.2.1") {
+		t.Fatalf("watchedRoutes() drain.example.com found %q", found)
+	}
+	SetOverride("one.example.com", "drain", "unit test", time.Time{})
+	diffRoutes(before, watchedRoutes())
+
+	e, ok := waitForEvent(ch, func(e Event) bool {
+		return e.Kind == "route" && e.Target == "drain.example.com" && e.View == DEFAULT && e.Qtype == "A"
+	})
+	if !ok {
+		t.Fatalf("no route event for drain.example.com")
+	}
+	if !strings.Contains(e.Old, "192.0.2.1") || strings.Contains(e.New, "192.0.2.1") {
+		t.Errorf("route event old %q new %q", e.Old, e.New)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	initGlobal("t/etc")
+	ts := httptest.NewServer(http.HandlerFunc(myHTTPEventsHandler))
+	defer ts.Close()
+
+	client := http.Client{Timeout: time.Duration(5) * time.Second}
+	resp, err := client.Get(ts.URL + "/gslb/events?kind=cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	Publish(Event{Kind: "health", Target: "filtered.example.com"}) // Not wanted
+	ClearCaches("unit testing TestEventsHandler")
+
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading events: %v", err)
+		}
+		if strings.Contains(line, "filtered.example.com") {
+			t.Errorf("kind=cache let through %q", line)
+		}
+		if strings.HasPrefix(line, "data: ") && strings.Contains(line, "unit testing TestEventsHandler") {
+			break
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"runtime"
 
 	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
 )
 
 // ErrBadIP is returned if the IP address is not parseable
@@ -34,6 +35,7 @@ var ErrNotLoaded = errors.New("data not yet loaded")
 // the geoip2 resources
 type GeoIP2 struct {
 	handle   *geoip2.Reader
+	networks *maxminddb.Reader // The same file, for the network an address is in
 	fileInfo FileInfoType
 	lookup   func(string) (string, error)
 }
@@ -49,6 +51,10 @@ func (m *GeoIP2) Close() {
 		m.handle.Close()
 		m.handle = nil
 	}
+	if m.networks != nil {
+		m.networks.Close()
+		m.networks = nil
+	}
 }
 
 // Handle gets the geoip2 Reader handle
@@ -90,6 +96,20 @@ func (m *GeoIP2) ISP(ipstring string) (*geoip2.ISP, error) {
 	return record, nil
 }
 
+// Network finds the network (as listed in the database) that an IP is in.
+func (m *GeoIP2) Network(ipstring string) (*net.IPNet, bool) {
+	ip := net.ParseIP(ipstring)
+	if ip == nil || m.networks == nil {
+		return nil, false
+	}
+	var skip struct{} // We only want the network, not the record
+	network, ok, err := m.networks.LookupNetwork(ip, &skip)
+	if err != nil || !ok {
+		return nil, false
+	}
+	return network, true
+}
+
 // NewGeoIP2 loads a MaxMind GeoIP2 database, returns
 // a convience handle common to the gslb project.
 func NewGeoIP2(fileName string) (*GeoIP2, error) {
@@ -117,5 +137,6 @@ func NewGeoIP2(fileName string) (*GeoIP2, error) {
 	if err != nil {
 		return m, err
 	}
+	m.networks, err = maxminddb.Open(fileName)
 	return m, err
 }
@@ -37,6 +37,7 @@ type GlobalStruct struct {
 	ViewData      atomic.Value // dynamic: ASN to ISP and Resolver to ISP lookups
 	GeoIP2Country atomic.Value // GeoIP2
 	GeoIP2ISP     atomic.Value // GeoIP2
+	Keys          atomic.Value // DNSSEC signing keys, by zone
 }
 
 // Global is a container for our global variables.
@@ -64,6 +65,13 @@ func initGlobal(etc string) {
 
 		LoadConfigs(etc)
 		go taskScanConfigs(etc)
+		go taskTimeWindows()
+		if !*probeAgentFlag { // A probe agent runs health checks, and nothing else
+			go taskWatchRoutes()
+			go taskPeers()
+			go taskRollover(etc)
+			go taskTransfers()
+		}
 	}
 	initOnce.Do(onceBody)
 
@@ -135,9 +143,11 @@ func LoadConfigs(path string) {
 
 	loadConfig(path + "/server.conf") // Latest server config object
 	loadZone(path + "/zone.conf")
+	loadKeys(path)                                          // DNSSEC keys, if any
 	loadGeoIP2Country("/var/lib/GeoIP/GeoIP2-Country.mmdb") // Used for Country ISO
 	loadGeoIP2ISP("/var/lib/GeoIP/GeoIP2-ISP.mmdb")         // Used for ASN and ISP name
 	scanForHealthChecks()                                   // Starts new background checks if needed
+	Publish(Event{Kind: "reload", Target: path})            // Tell anyone watching /gslb/events
 	ClearCaches("Configuration files loaded")               // Flush any and all caches after any config has changed
 }
 
@@ -210,27 +220,39 @@ func taskScanConfigs(etc string) {
 	}
 }
 
+// checkInterval returns how often (in seconds) to poll a service,
+// from the [interval] section of server.conf.
+func checkInterval(service string) int {
+	sleepsecs := int(30) // fallback
+	if sleepsecsStr, ok := GlobalConfig().GetSectionNameValueString("interval", service); ok {
+		sleepsecs, _ = strconv.Atoi(sleepsecsStr)
+	}
+	return sleepsecs
+}
+
 func scanForHealthChecks() {
 	z := GlobalZoneData() // Safely copy a pointer to latest
-	c := GlobalConfig()   // Safely copy a pointer to latest
 
 	// Need to read all the data, see what health checks are needed
 	for key, val := range z.Data {
 		//		fmt.Printf("key=%v val=%v\n", key, val)
 		for _, s := range val.Values {
-			words := strings.Fields(s)
+			words, _ := splitQualifiers(strings.Fields(s)) // Time windows aside, a check is a check
 			if words[0] == "HC" {
 				if false {
 					Debugf("key=%v check=%v name=%v\n", key, words[1], words[2])
 				}
 				service := words[1]
 				target := words[2]
-
-				sleepsecs := int(30) // fallback
-				if sleepsecsStr, ok := c.GetSectionNameValueString("interval", service); ok {
-					sleepsecs, _ = strconv.Atoi(sleepsecsStr)
+				addCheckAndMembers(service, target)
+			}
+			if words[0] == "DELEGATE" && len(words) >= 3 {
+				// Name servers of a delegated zone may be health checked too.
+				if service, ok := delegateCheck(words[1]); ok {
+					for _, target := range words[2:] {
+						addCheckAndMembers(service, target)
+					}
 				}
-				AddCheck(service, target, sleepsecs)
 			}
 		}
 	}
@@ -25,6 +25,23 @@ func TestConfigSwapped(t *testing.T) {
 
 }
 
+func TestScanForHealthChecks(t *testing.T) {
+	initGlobal("t/etc")
+	scanForHealthChecks()
+
+	// windowed.example.com DELEGATEs to ns1.sub.example.com, except=Mon/00:00-01:00
+	HealthChecks.Lock.RLock()
+	defer HealthChecks.Lock.RUnlock()
+	if _, ok := HealthChecks.Info[ServiceTargetKey{"check_unit_delegate", "ns1.sub.example.com"}]; !ok {
+		t.Errorf("no check_unit_delegate check for ns1.sub.example.com")
+	}
+	for key := range HealthChecks.Info {
+		if isTimeQualifier(key.Target) {
+			t.Errorf("health check registered for a time qualifier: %v", key)
+		}
+	}
+}
+
 func Benchmark_GlobalConfig(b *testing.B) {
 	// Expensive stuff first
 	initGlobal("t/etc")
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -153,3 +154,43 @@ func SleepWithVariance(t time.Duration) {
 	t2 := time.Duration(float64(t) * amt) // .. of the original amount
 	time.Sleep(t2)
 }
+
+// SleepWithVarianceOrWake is SleepWithVariance, cut short by anything sent to wake.
+func SleepWithVarianceOrWake(t time.Duration, wake <-chan bool) {
+	amt := 0.9 + rand.Float64()/5.0       // 0.9x to 1.1x
+	t2 := time.Duration(float64(t) * amt) // .. of the original amount
+	timer := time.NewTimer(t2)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-wake:
+	}
+}
+
+// remoteIP is the IP address of a DNS client.
+func remoteIP(remote net.Addr) net.IP {
+	switch a := remote.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return net.ParseIP(parseIpOnly(remote.String()))
+}
+
+// addrAllowed returns true if an IP is in an allow list of IPs and CIDRs.
+func addrAllowed(ip net.IP, list []string) bool {
+	if ip == nil {
+		return false
+	}
+	for _, s := range list {
+		if _, network, err := net.ParseCIDR(s); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(s); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+package main
+
+/*
+Health check status, as JSON.
+
+  /gslb/api/checks                     every check
+  /gslb/api/checks?service=check_http  just some (service=, target=)
+  /gslb/api/checks?history=1           with the last few results
+  /gslb/api/target/NAME                every check of one target, with
+                                       history, and the zone names that use it
+
+How many results to keep is set in server.conf:
+
+[healthcheck]
+history: 20
+*/
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HistoryDefault is how many results we keep per check, if server.conf does not say.
+var HistoryDefault = 20
+
+// CheckResult is the outcome of one poll of a check.
+type CheckResult struct {
+	Time    time.Time `json:"time"`
+	State   string    `json:"state"`
+	Latency float64   `json:"latency_ms,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// CheckStatus is everything we know about one check, for the JSON API.
+type CheckStatus struct {
+	Service    string          `json:"service"`
+	Target     string          `json:"target"`
+	Status     bool            `json:"status"` // After any override
+	State      string          `json:"state"`  // After any override
+	Override   *Override       `json:"override,omitempty"`
+	Changed    time.Time       `json:"changed"`
+	LastError  string          `json:"last_error,omitempty"`
+	Latency    float64         `json:"latency_ms"`
+	LatencyAvg float64         `json:"latency_avg_ms"`
+	Passes     int             `json:"consecutive_passes"`
+	Fails      int             `json:"consecutive_fails"`
+	Interval   int             `json:"interval"`
+	Polls      int             `json:"polls"`
+	Addrs      map[string]bool `json:"addrs,omitempty"`
+	History    []CheckResult   `json:"history,omitempty"`
+	Dependents []Dependent     `json:"dependents,omitempty"`
+}
+
+// Dependent is a zone name (in some view) with an HC line for a target.
+type Dependent struct {
+	Name string `json:"name"`
+	View string `json:"view"`
+}
+
+// historySize returns how many results to keep per check.
+func historySize() int {
+	if i, ok := GlobalConfig().GetSectionNameValueInt("healthcheck", "history"); ok && i >= 0 {
+		return i
+	}
+	return HistoryDefault
+}
+
+// milliseconds turns a duration into (fractional) milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// recordResult adds the outcome of a poll to the history of a check,
+// and keeps count of consecutive passes and fails.
+// Only checks started by AddCheck are updated.
+func recordResult(service string, target string, status bool, latency time.Duration, err error) {
+	keep := historySize()
+	now := time.Now().UTC()
+	HealthChecks.Lock.Lock() // RW
+	defer HealthChecks.Lock.Unlock()
+	info, found := HealthChecks.Info[ServiceTargetKey{service, target}]
+	if !found {
+		return
+	}
+
+	r := CheckResult{Time: now, State: StateDown.String()}
+	if status {
+		r.State = StateUp.String()
+		if info.Degraded {
+			r.State = StateDegraded.String()
+		}
+		r.Latency = milliseconds(latency)
+		info.Passes++
+		info.Fails = 0
+	} else {
+		info.Fails++
+		info.Passes = 0
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	info.LastError = r.Error // Cleared by a poll without an error
+
+	if info.LastState != r.State {
+		info.Changed = now
+		info.LastState = r.State
+	}
+	info.History = append(info.History, r)
+	if len(info.History) > keep {
+		info.History = info.History[len(info.History)-keep:] // The next append copies, so this stays bounded
+	}
+}
+
+// dependents finds the zone names (and views) with an HC line for a target.
+func dependents(target string) []Dependent {
+	ret := []Dependent{}
+	z := GlobalZoneData()
+	for key, val := range z.Data {
+		for _, s := range val.Values {
+			words := strings.Fields(s)
+			if len(words) >= 3 && toUpper(words[0]) == "HC" && words[2] == target {
+				ret = append(ret, Dependent{Name: key.Name, View: key.Section})
+				break
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Name != ret[j].Name {
+			return ret[i].Name < ret[j].Name
+		}
+		return ret[i].View < ret[j].View
+	})
+	return ret
+}
+
+// checkStatuses copies the status of every check matching the filters ("" matches all).
+func checkStatuses(service string, target string, history bool) []CheckStatus {
+	ret := []CheckStatus{}
+	HealthChecks.Lock.RLock() // RO
+	for key, status := range HealthChecks.Status {
+		if (service != "" && key.Service != service) || (target != "" && key.Target != target) {
+			continue
+		}
+		cs := CheckStatus{Service: key.Service, Target: key.Target}
+		o := HealthChecks.Overrides[overrideKey(key.Target)]
+		cs.Status = o.apply(status)
+		if o != nil && o.Active() {
+			copied := *o
+			cs.Override = &copied
+		}
+		cs.State = StateDown.String()
+		info := HealthChecks.Info[key]
+		if info == nil {
+			info = new(CheckInfo)
+		}
+		if cs.Status {
+			cs.State = StateUp.String()
+			if info.Degraded {
+				cs.State = StateDegraded.String()
+			}
+		}
+		cs.Changed = info.Changed
+		cs.LastError = info.LastError
+		cs.Latency = milliseconds(info.Latency)
+		cs.LatencyAvg = milliseconds(info.LatencyAvg)
+		cs.Passes = info.Passes
+		cs.Fails = info.Fails
+		cs.Interval = info.Interval
+		cs.Polls = info.Polls
+		if info.Addrs != nil {
+			cs.Addrs = make(map[string]bool, len(info.Addrs))
+			for addr, up := range info.Addrs {
+				cs.Addrs[addr] = up
+			}
+		}
+		if history {
+			cs.History = append([]CheckResult{}, info.History...)
+		}
+		ret = append(ret, cs)
+	}
+	HealthChecks.Lock.RUnlock() // RO
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Service != ret[j].Service {
+			return ret[i].Service < ret[j].Service
+		}
+		return ret[i].Target < ret[j].Target
+	})
+	return ret
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// myHTTPChecksHandler serves /gslb/api/checks
+func myHTTPChecksHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	history := q.Get("history") != "" && q.Get("history") != "0"
+	writeJSON(w, checkStatuses(q.Get("service"), toLower(q.Get("target")), history))
+}
+
+// myHTTPTargetHandler serves /gslb/api/target/NAME
+func myHTTPTargetHandler(w http.ResponseWriter, r *http.Request) {
+	target := toLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/gslb/api/target/"), "/"))
+	if target == "" {
+		http.Error(w, "wanted /gslb/api/target/NAME", http.StatusBadRequest)
+		return
+	}
+	checks := checkStatuses("", target, true)
+	if len(checks) == 0 {
+		http.Error(w, "no health checks for "+target, http.StatusNotFound)
+		return
+	}
+	deps := dependents(target)
+	for i := range checks {
+		checks[i].Dependents = deps
+	}
+	writeJSON(w, checks)
+}
+
+func init() {
+	http.HandleFunc("/gslb/api/checks", myHTTPChecksHandler)
+	http.HandleFunc("/gslb/api/target/", myHTTPTargetHandler)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecordResult(t *testing.T) {
+	initGlobal("t/etc")
+	AddCheck("check_true", "history.example.com", 3600)
+	waitForPoll("check_true", "history.example.com")
+
+	for i := 0; i < HistoryDefault+5; i++ {
+		recordResult("check_true", "history.example.com", true, time.Millisecond, nil)
+	}
+	recordResult("check_true", "history.example.com", false, 0, errors.New("unit test failure"))
+	recordResult("check_true", "history.example.com", false, 0, errors.New("unit test failure"))
+
+	checks := checkStatuses("check_true", "history.example.com", true)
+	if len(checks) != 1 {
+		t.Fatalf("checkStatuses() found %v checks", len(checks))
+	}
+	cs := checks[0]
+	if len(cs.History) != HistoryDefault {
+		t.Errorf("history has %v results, wanted %v", len(cs.History), HistoryDefault)
+	}
+	if cs.Fails != 2 || cs.Passes != 0 || cs.LastError != "unit test failure" || cs.Interval != 3600 {
+		t.Errorf("checkStatuses() found %+v", cs)
+	}
+	if last := cs.History[len(cs.History)-1]; last.State != "down" || !cs.Changed.Equal(cs.History[len(cs.History)-2].Time) {
+		t.Errorf("last result %+v, changed %v", last, cs.Changed)
+	}
+
+	// A pass clears the error.
+	recordResult("check_true", "history.example.com", true, time.Millisecond, nil)
+	if cs := checkStatuses("check_true", "history.example.com", false)[0]; cs.LastError != "" {
+		t.Errorf("last_error %q after a pass", cs.LastError)
+	}
+}
+
+func TestRecordResultNoHistory(t *testing.T) {
+	initGlobal("t/etc")
+	AddCheck("check_true", "nohistory.example.com", 3600)
+	waitForPoll("check_true", "nohistory.example.com")
+	defer func(keep int) { HistoryDefault = keep }(HistoryDefault)
+	HistoryDefault = 0
+
+	recordResult("check_true", "nohistory.example.com", true, time.Millisecond, nil)
+	changed := checkStatuses("check_true", "nohistory.example.com", false)[0].Changed
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	recordResult("check_true", "nohistory.example.com", true, time.Millisecond, nil)
+	cs := checkStatuses("check_true", "nohistory.example.com", true)[0]
+	if len(cs.History) != 0 || !cs.Changed.Equal(changed) {
+		t.Errorf("with no history, changed %v then %v, history %v", changed, cs.Changed, cs.History)
+	}
+}
+
+func TestTargetHandler(t *testing.T) {
+	initGlobal("t/etc")
+	waitForPoll("check_true", "one.example.com")
+
+	w := httptest.NewRecorder()
+	myHTTPTargetHandler(w, httptest.NewRequest("GET", "/gslb/api/target/one.example.com", nil))
+	checks := []CheckStatus{}
+	if err := json.Unmarshal(w.Body.Bytes(), &checks); err != nil {
+		t.Fatalf("/gslb/api/target/one.example.com: %v: %s", err, w.Body.String())
+	}
+	found := false
+	for _, cs := range checks {
+		if cs.Service != "check_true" {
+			continue
+		}
+		found = true
+		if len(cs.History) == 0 {
+			t.Errorf("check_true one.example.com has no history")
+		}
+		hc := false
+		for _, d := range cs.Dependents {
+			hc = hc || (d.Name == "hc.example.com" && d.View == "default")
+		}
+		if !hc {
+			t.Errorf("dependents of one.example.com %v missing hc.example.com", cs.Dependents)
+		}
+	}
+	if !found {
+		t.Errorf("/gslb/api/target/one.example.com has no check_true: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	myHTTPTargetHandler(w, httptest.NewRequest("GET", "/gslb/api/target/nowhere.example.com", nil))
+	if w.Code != 404 {
+		t.Errorf("/gslb/api/target/nowhere.example.com returned %v", w.Code)
+	}
+}
@@ -22,6 +22,7 @@ var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 var memprofile = flag.String("memprofile", "", "write cpu profile to file")
 var profile = flag.Bool("profile", false, "export profiler to port 28000")
 var httpOption = flag.String("http", "", "Start HTTP server, ie: :28000")
+var probeAgentFlag = flag.Bool("probe-agent", false, "Run health checks only, and report them to the [probe] report URLs")
 
 func init() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
@@ -110,7 +111,17 @@ func main() {
 	log.Printf("main()\n")
 	initGlobal(*etcFlag)
 	startHTTP()
-	startDNS()
+	if *probeAgentFlag {
+		go func() { // No DNS; just health checks, reported elsewhere
+			waitForReady(readyTimeout())
+			setReady()
+			runProbeAgent()
+		}()
+	} else {
+		waitForReady(readyTimeout()) // Give the health checks a chance at one full round
+		startDNS()
+		setReady()
+	}
 	log.Printf("Sitting and waiting ()\n")
 
 	// Who wants to live forever?
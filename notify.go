@@ -0,0 +1,356 @@
+package main
+
+/*
+Notifications.
+
+Health state changes (up, degraded, down) can be sent somewhere other
+than the log.  Configure in server.conf:
+
+[notify]
+webhook: https://hooks.example.com/gslb   # POSTs JSON; may be listed more than once
+syslog: yes                               # local syslog, facility daemon
+log: /var/log/gslb/events.jsonl           # append-only, one JSON event per line
+retries: 5                                # per notifier, per event
+backoff: 2                                # seconds before the first retry; doubles each time
+rate_limit: 60                            # seconds; at most one event per target this often
+
+A name whose health checked pool has failed entirely (and is answered
+from its FB line, or from the rerun with health checks disabled) sends
+its own "pool" event, with the new state "fallback", "rerun" or
+"on-all-down"; and another ("up") when any of the pool comes back.
+These are worked out when a health check or an operator override
+changes, not when answering.
+
+The first poll of a check (at startup) does not count as a change.
+
+Events held back by rate_limit are not lost: when the limit allows, the
+latest state of the target is sent (if it is not the one last sent).
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is one notification.
+type Event struct {
+	Kind    string    `json:"kind"` // "health", "pool"; see also events.go
+	Service string    `json:"service,omitempty"`
+	Target  string    `json:"target"`
+	View    string    `json:"view,omitempty"`
+	Qtype   string    `json:"qtype,omitempty"`
+	Old     string    `json:"old"`
+	New     string    `json:"new"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Notifier is somewhere to send events.
+type Notifier interface {
+	Notify(e Event) error
+	String() string
+}
+
+// WebhookNotifier POSTs each event as JSON.
+type WebhookNotifier struct {
+	URL string
+}
+
+// Notify implements Notifier.
+func (n WebhookNotifier) Notify(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: time.Duration(10) * time.Second}
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", n.URL, resp.Status)
+	}
+	return nil
+}
+
+func (n WebhookNotifier) String() string {
+	return "webhook " + n.URL
+}
+
+// LogNotifier appends each event to a file, as one line of JSON.
+type LogNotifier struct {
+	Path string
+}
+
+var logNotifierLock sync.Mutex
+
+// Notify implements Notifier.
+func (n LogNotifier) Notify(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	logNotifierLock.Lock()
+	defer logNotifierLock.Unlock()
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (n LogNotifier) String() string {
+	return "log " + n.Path
+}
+
+var syslogOnce sync.Once
+var syslogShared Notifier // One connection to syslog, shared by every event
+
+// notifiers returns the notifiers configured in server.conf.
+func notifiers() (list []Notifier) {
+	c := GlobalConfig()
+	if urls, ok := c.GetSectionNameValueStrings("notify", "webhook"); ok {
+		for _, url := range urls {
+			list = append(list, WebhookNotifier{URL: url})
+		}
+	}
+	if path, ok := c.GetSectionNameValueString("notify", "log"); ok {
+		list = append(list, LogNotifier{Path: path})
+	}
+	if use, _ := c.GetSectionNameValueBool("notify", "syslog"); use {
+		syslogOnce.Do(func() {
+			var err error
+			if syslogShared, err = newSyslogNotifier(); err != nil {
+				log.Printf("notify: syslog unavailable: %v\n", err)
+			}
+		})
+		if syslogShared != nil {
+			list = append(list, syslogShared)
+		}
+	}
+	return list
+}
+
+var notifyLock sync.Mutex
+var notifyStates = make(map[string]*notifyState) // By kind, service, target and view; for rate limiting
+
+// notifyState is what was last sent about a target, and anything held back since.
+type notifyState struct {
+	last    time.Time // When the last event was sent
+	sent    string    // Its new state
+	pending *Event    // The latest event held back by the rate limit
+}
+
+// notifyRateLimit is the least time between events about a target.
+func notifyRateLimit() time.Duration {
+	if secs, ok := GlobalConfig().GetSectionNameValueInt("notify", "rate_limit"); ok {
+		return time.Duration(secs) * time.Second
+	}
+	return 0
+}
+
+// notifyAllowed returns true if the target has not had an event of this kind
+// within [notify] rate_limit seconds.  If it has, the event is held; the
+// latest one held goes out once the limit allows (see notifyHeld).
+func notifyAllowed(e Event) bool {
+	limit := notifyRateLimit()
+	key := e.Kind + " " + e.Service + " " + e.Target + " " + e.View
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+	notifyPrune(e.Time, limit)
+	st, ok := notifyStates[key]
+	if !ok || e.Time.Sub(st.last) >= limit {
+		if limit > 0 {
+			notifyStates[key] = &notifyState{last: e.Time, sent: e.New}
+		}
+		return true
+	}
+	if st.pending == nil {
+		time.AfterFunc(st.last.Add(limit).Sub(e.Time), func() { notifyHeld(key) })
+	}
+	st.pending = &e
+	return false
+}
+
+// notifyHeld sends the latest event held back for a target, unless the
+// target is back where the last event left it.
+func notifyHeld(key string) {
+	notifyLock.Lock()
+	st, ok := notifyStates[key]
+	if !ok || st.pending == nil {
+		notifyLock.Unlock()
+		return
+	}
+	e := *st.pending
+	st.pending = nil
+	if e.New == st.sent {
+		notifyLock.Unlock()
+		statsNotify.Increment("coalesced")
+		return
+	}
+	e.Old = st.sent
+	st.last, st.sent = time.Now().UTC(), e.New
+	notifyLock.Unlock()
+	notifySend(e)
+}
+
+// notifyPrune forgets targets whose rate limit is over, with nothing held.
+// Must be called with notifyLock held.
+func notifyPrune(now time.Time, limit time.Duration) {
+	for key, st := range notifyStates {
+		if st.pending == nil && now.Sub(st.last) >= limit {
+			delete(notifyStates, key)
+		}
+	}
+}
+
+// Notify sends an event to every configured notifier, in the background.
+func Notify(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if len(notifiers()) == 0 {
+		return
+	}
+	if !notifyAllowed(e) {
+		statsNotify.Increment("ratelimited")
+		return
+	}
+	notifySend(e)
+}
+
+// notifySend sends an event to every configured notifier, without rate limits.
+func notifySend(e Event) {
+	c := GlobalConfig()
+	retries, ok := c.GetSectionNameValueInt("notify", "retries")
+	if !ok {
+		retries = 3
+	}
+	backoff := time.Duration(2) * time.Second
+	if secs, ok := c.GetSectionNameValueInt("notify", "backoff"); ok {
+		backoff = time.Duration(secs) * time.Second
+	}
+	for _, n := range notifiers() {
+		go notifyWithRetry(n, e, retries, backoff)
+	}
+}
+
+// notifyWithRetry tries a notifier until it works, doubling the wait each time.
+func notifyWithRetry(n Notifier, e Event, retries int, backoff time.Duration) {
+	for attempt := 0; ; attempt++ {
+		err := n.Notify(e)
+		if err == nil {
+			statsNotify.Increment("sent")
+			return
+		}
+		if attempt >= retries {
+			statsNotify.Increment("failed")
+			log.Printf("notify: %v: giving up on %s %s: %v\n", n, e.Kind, e.Target, err)
+			return
+		}
+		statsNotify.Increment("retried")
+		time.Sleep(backoff << uint(attempt))
+	}
+}
+
+// PoolKey is a name in a view, for pool events.
+type PoolKey struct {
+	Name string
+	View string
+}
+
+var poolLock sync.Mutex
+var poolStates = make(map[PoolKey]string) // "up", or how the name is answered with its pool down
+
+// poolState works out whether a name's health checked pool is up, and if
+// not, how the name is answered: "fallback", "rerun" or "on-all-down".
+func poolState(zoneRef *Config, view string, lines []string) string {
+	now := time.Now()
+	fallback := false
+	for _, line := range lines {
+		words, active := activeWords(line, now)
+		if !active || len(words) < 2 {
+			continue
+		}
+		switch toUpper(words[0]) {
+		case "HC":
+			if len(words) >= 3 && !Drained(words[2]) {
+				if up, _ := GetStatus(words[1], words[2]); up {
+					return "up"
+				}
+			}
+		case "FB":
+			fallback = true
+		}
+	}
+	if fallback {
+		return "fallback"
+	}
+	if policy, _ := allDownPolicy(zoneRef, view, lines); toLower(policy[0]) == "rerun" {
+		return "rerun"
+	}
+	return "on-all-down"
+}
+
+// poolsOf lists the names (in every view) with an HC line for a check.
+func poolsOf(zoneRef *Config, service string, target string) map[PoolKey][]string {
+	pools := make(map[PoolKey][]string)
+	for key, val := range zoneRef.Data {
+		for _, s := range val.Values {
+			words := strings.Fields(s)
+			if len(words) >= 3 && toUpper(words[0]) == "HC" && words[1] == service && words[2] == target {
+				pools[PoolKey{key.Name, key.Section}] = val.Values
+				break
+			}
+		}
+	}
+	return pools
+}
+
+// notifyPools sends a "pool" event for every name whose pool failed
+// entirely, or came back, with this change of a check.  At startup
+// (firstPoll), the states are only noted.
+func notifyPools(service string, target string, firstPoll bool) {
+	zoneRef := GlobalZoneData()
+	for k, lines := range poolsOf(zoneRef, service, target) {
+		state := poolState(zoneRef, k.View, lines)
+		poolLock.Lock()
+		old, known := poolStates[k]
+		poolStates[k] = state
+		poolLock.Unlock()
+		if !known || firstPoll || old == state || (old != "up" && state != "up") {
+			continue
+		}
+		e := Event{Kind: "pool", Target: k.Name, View: k.View, Old: old, New: state, Time: time.Now().UTC()}
+		Publish(e)
+		Notify(e)
+	}
+}
+
+// notifyTargetPools is notifyPools for every check of a target, for when an
+// operator override changes its state without a health check changing.
+func notifyTargetPools(target string) {
+	var keys []ServiceTargetKey
+	HealthChecks.Lock.RLock() // RO
+	for key := range HealthChecks.Info {
+		if overrideKey(key.Target) == overrideKey(target) {
+			keys = append(keys, key)
+		}
+	}
+	HealthChecks.Lock.RUnlock() // RO
+	for _, key := range keys {
+		notifyPools(key.Service, key.Target, false)
+	}
+}
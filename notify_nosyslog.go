@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+func newSyslogNotifier() (Notifier, error) {
+	return nil, errors.New("no syslog on this platform")
+}
@@ -0,0 +1,38 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogNotifier sends each event to the local syslog, as JSON.
+type SyslogNotifier struct {
+	w *syslog.Writer
+}
+
+func newSyslogNotifier() (Notifier, error) {
+	w, err := syslog.New(syslog.LOG_NOTICE|syslog.LOG_DAEMON, "gslb")
+	if err != nil {
+		return nil, err
+	}
+	return SyslogNotifier{w: w}, nil
+}
+
+// Notify implements Notifier.
+func (n SyslogNotifier) Notify(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.New == "down" || (e.Kind == "pool" && e.New != "up") {
+		return n.w.Warning(string(line))
+	}
+	return n.w.Notice(string(line))
+}
+
+func (n SyslogNotifier) String() string {
+	return "syslog"
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifyWebhookRetry(t *testing.T) {
+	initGlobal("t/etc")
+	var calls int32
+	got := make(chan Event, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable) // Fail twice, then work
+			return
+		}
+		var e Event
+		json.NewDecoder(r.Body).Decode(&e)
+		got <- e
+	}))
+	defer ts.Close()
+
+	e := Event{Kind: "health", Service: "check_true", Target: "one.example.com", Old: "up", New: "down", Time: time.Now()}
+	notifyWithRetry(WebhookNotifier{URL: ts.URL}, e, 5, time.Millisecond)
+	select {
+	case found := <-got:
+		if found.Target != e.Target || found.Old != "up" || found.New != "down" {
+			t.Errorf("webhook got %+v", found)
+		}
+	default:
+		t.Errorf("webhook never succeeded, %v calls", atomic.LoadInt32(&calls))
+	}
+
+	// Out of retries
+	atomic.StoreInt32(&calls, -100)
+	notifyWithRetry(WebhookNotifier{URL: ts.URL}, e, 2, time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != -97 {
+		t.Errorf("webhook with 2 retries called %v times, wanted 3", n+100)
+	}
+}
+
+func TestNotifyLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n := LogNotifier{Path: filepath.Join(dir, "events.jsonl")}
+	for _, target := range []string{"one.example.com", "two.example.com"} {
+		if err := n.Notify(Event{Kind: "health", Target: target, Old: "up", New: "down"}); err != nil {
+			t.Fatalf("LogNotifier.Notify(): %v", err)
+		}
+	}
+	data, _ := ioutil.ReadFile(n.Path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"target":"two.example.com"`) {
+		t.Errorf("LogNotifier wrote %q", data)
+	}
+}
+
+func TestNotifyAllowed(t *testing.T) {
+	initGlobal("t/etc")
+	now := time.Now()
+	var tests = []struct {
+		kind    string
+		target  string
+		at      time.Duration
+		allowed bool
+	}{
+		{"health", "ratelimit.example.com", 0, true},
+		{"health", "ratelimit.example.com", 10 * time.Second, false},
+		{"pool", "ratelimit.example.com", 10 * time.Second, true}, // Different kind
+		{"health", "other.example.com", 10 * time.Second, true},
+		{"health", "ratelimit.example.com", 61 * time.Second, true},
+	}
+	for _, tt := range tests {
+		e := Event{Kind: tt.kind, Target: tt.target, Time: now.Add(tt.at)}
+		if found := notifyAllowed(e); found != tt.allowed {
+			t.Errorf("notifyAllowed(%s %s +%v) wanted %v found %v", tt.kind, tt.target, tt.at, tt.allowed, found)
+		}
+	}
+}
+
+func TestNotifyHeld(t *testing.T) {
+	initGlobal("t/etc")
+	now := time.Now()
+	key := "health  held.example.com "
+	var tests = []struct {
+		at      time.Duration
+		state   string
+		allowed bool
+		flush   bool   // Call notifyHeld after this one
+		sent    string // The last state sent, after this one
+	}{
+		{0, "down", true, false, "down"},
+		{10 * time.Second, "up", false, true, "up"},     // Held, then sent
+		{20 * time.Second, "down", false, true, "down"}, // Held, then sent
+		{30 * time.Second, "up", false, false, "down"},  // Replaced by the next one
+		{40 * time.Second, "down", false, true, "down"}, // Back where it was: coalesced
+	}
+	for _, tt := range tests {
+		e := Event{Kind: "health", Target: "held.example.com", New: tt.state, Time: now.Add(tt.at)}
+		if found := notifyAllowed(e); found != tt.allowed {
+			t.Errorf("notifyAllowed(+%v %s) wanted %v found %v", tt.at, tt.state, tt.allowed, found)
+		}
+		if tt.flush {
+			notifyHeld(key)
+		}
+		notifyLock.Lock()
+		if st := notifyStates[key]; st == nil || st.sent != tt.sent || (st.pending == nil) != (tt.allowed || tt.flush) {
+			t.Errorf("after +%v %s state %+v, wanted sent %q", tt.at, tt.state, st, tt.sent)
+		}
+		notifyLock.Unlock()
+	}
+}
+
+func TestNotifyPrune(t *testing.T) {
+	initGlobal("t/etc")
+	now := time.Now()
+	notifyAllowed(Event{Kind: "health", Target: "prune.example.com", Time: now})
+	notifyAllowed(Event{Kind: "health", Target: "other-prune.example.com", Time: now.Add(61 * time.Second)})
+	notifyLock.Lock()
+	defer notifyLock.Unlock()
+	if _, found := notifyStates["health  prune.example.com "]; found {
+		t.Errorf("notifyStates still has prune.example.com, 61s later")
+	}
+	if _, found := notifyStates["health  other-prune.example.com "]; !found {
+		t.Errorf("notifyStates lost other-prune.example.com")
+	}
+}
+
+func TestNotifyPools(t *testing.T) {
+	initGlobal("t/etc")
+	waitForPoll("check_true", "one.example.com")
+	waitForPoll("check_true", "two.example.com")
+	waitForPoll("check_false", "two.example.com")
+	ch := Subscribe()
+	defer Unsubscribe(ch)
+	defer ClearOverride("one.example.com")
+	isPool := func(e Event) bool {
+		return e.Kind == "pool" && e.Target == "hc.example.com" && e.View == DEFAULT
+	}
+
+	SetOverride("one.example.com", "force-down", "unit test", time.Time{})
+	if e, ok := waitForEvent(ch, isPool); !ok || e.Old != "up" || e.New != "rerun" {
+		t.Errorf("pool event for hc.example.com going down: %+v %v", e, ok)
+	}
+	ClearOverride("one.example.com")
+	if e, ok := waitForEvent(ch, isPool); !ok || e.Old != "rerun" || e.New != "up" {
+		t.Errorf("pool event for hc.example.com recovering: %+v %v", e, ok)
+	}
+	if e, ok := waitForEvent(ch, isPool); ok {
+		t.Errorf("extra pool event for hc.example.com: %+v", e)
+	}
+}
+
+func TestPoolState(t *testing.T) {
+	initGlobal("t/etc")
+	waitForPoll("check_true", "one.example.com")
+	waitForPoll("check_false", "one.example.com")
+	zoneRef := GlobalZoneData()
+	var tests = []struct {
+		lines []string
+		state string
+	}{
+		{[]string{"HC check_true one.example.com", "A 192.0.2.1"}, "up"},
+		{[]string{"HC check_false one.example.com", "A 192.0.2.1"}, "rerun"},
+		{[]string{"HC check_false one.example.com", "FB two.example.com"}, "fallback"},
+		{[]string{"HC check_false one.example.com", "ON-ALL-DOWN empty"}, "on-all-down"},
+		{[]string{"HC check_true one.example.com except=Mon-Sun/00:00-24:00", "HC check_false one.example.com"}, "rerun"},
+	}
+	for _, tt := range tests {
+		if found := poolState(zoneRef, DEFAULT, tt.lines); found != tt.state {
+			t.Errorf("poolState(%q) wanted %q found %q", tt.lines, tt.state, found)
+		}
+	}
+}
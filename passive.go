@@ -0,0 +1,130 @@
+package main
+
+/*
+Passive health reports.
+
+Some sites can't be reached from our name servers, but can tell us how
+they are doing.  An agent at the site POSTs its own state:
+
+  curl -H "Authorization: Bearer $TOKEN" \
+       -d '{"target": "site-x", "status": true, "ttl": 60}' \
+       http://localhost:8080/gslb/passive
+
+and zone.conf uses it like any other check:
+
+  www.example.com: HC passive site-x
+
+A report holds for "ttl" seconds (default [passive] ttl, or 60); with no
+fresh report by then, the target goes down.  "message" is optional, and
+shows as the error in /gslb/hc and the JSON API.
+
+[passive]
+token: some-long-random-string
+ttl: 60
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PassiveDefaultTTL is how long a report holds, if neither it nor server.conf say.
+var PassiveDefaultTTL = 60
+
+// PassiveReport is what an agent pushes to /gslb/passive.
+type PassiveReport struct {
+	Target  string    `json:"target"`
+	Status  bool      `json:"status"`
+	TTL     int       `json:"ttl"`     // Seconds
+	Message string    `json:"message"` // Optional
+	Expires time.Time `json:"-"`
+}
+
+var passiveLock sync.RWMutex
+var passiveReports = make(map[string]PassiveReport)
+
+// SetPassiveReport stores a report, and has the "passive" check of the
+// target poll it right away.  The report is checked again once it expires.
+// Returns the report as stored (with the TTL filled in).
+func SetPassiveReport(report PassiveReport) PassiveReport {
+	if report.TTL <= 0 {
+		report.TTL = PassiveDefaultTTL
+		if i, ok := GlobalConfig().GetSectionNameValueInt("passive", "ttl"); ok && i > 0 {
+			report.TTL = i
+		}
+	}
+	ttl := time.Duration(report.TTL) * time.Second
+	report.Expires = time.Now().Add(ttl)
+
+	passiveLock.Lock()
+	passiveReports[report.Target] = report
+	passiveLock.Unlock()
+
+	refreshPassive(report.Target)
+	time.AfterFunc(ttl+time.Second, func() {
+		refreshPassive(report.Target) // Down, unless another report came in
+	})
+	return report
+}
+
+// refreshPassive wakes the "passive" check of a target, if zone.conf uses
+// it, to re-read the report.  Otherwise the report just waits for AddCheck.
+func refreshPassive(target string) {
+	wakeCheck("passive", target)
+}
+
+// checkPassive handles the "passive" service check, from the latest report.
+func checkPassive(target string) (bool, error) {
+	passiveLock.RLock()
+	report, ok := passiveReports[target]
+	passiveLock.RUnlock()
+	switch {
+	case !ok:
+		return false, fmt.Errorf("no report for %s", target)
+	case time.Now().After(report.Expires):
+		return false, fmt.Errorf("report for %s expired at %s", target, report.Expires.UTC().Format(time.RFC3339))
+	case !report.Status && report.Message != "":
+		return false, fmt.Errorf("reported down: %s", report.Message)
+	case !report.Status:
+		return false, fmt.Errorf("reported down")
+	}
+	return true, nil
+}
+
+// myHTTPPassiveHandler serves POST /gslb/passive
+func myHTTPPassiveHandler(w http.ResponseWriter, r *http.Request) {
+	if !tokenAuthorized(w, r, "passive") {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var report PassiveReport
+	if err := json.NewDecoder(io.LimitReader(r.Body, 65536)).Decode(&report); err != nil {
+		http.Error(w, "bad report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.Target = toLower(report.Target)
+	if report.Target == "" {
+		http.Error(w, "report has no target", http.StatusBadRequest)
+		return
+	}
+	report = SetPassiveReport(report)
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, ok := GetStatus("passive", report.Target); !ok {
+		io.WriteString(w, fmt.Sprintf("%s: stored, but no \"HC passive %s\" in zone.conf\n", report.Target, report.Target))
+		return
+	}
+	io.WriteString(w, fmt.Sprintf("%s: %v for %vs\n", report.Target, report.Status, report.TTL))
+}
+
+func init() {
+	http.HandleFunc("/gslb/passive", myHTTPPassiveHandler)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func passiveRequest(token string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/gslb/passive", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	myHTTPPassiveHandler(w, r)
+	return w
+}
+
+// waitForStatus waits up to a second for a check to reach a status.
+func waitForStatus(service string, target string, want bool) bool {
+	for i := 0; i < 100; i++ {
+		if status, _ := GetStatus(service, target); status == want {
+			return true
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	return false
+}
+
+func TestPassive(t *testing.T) {
+	initGlobal("t/etc")
+	zoneRef := GlobalZoneData()
+	notrace := NewLookupTraceOff()
+	waitForPoll("passive", "site-x.example.com")
+
+	if status, _ := GetStatus("passive", "site-x.example.com"); status != false {
+		t.Errorf("passive site-x.example.com up with no report")
+	}
+
+	var tests = []struct {
+		token string
+		body  string
+		code  int
+	}{
+		{"", `{"target": "site-x.example.com", "status": true}`, http.StatusUnauthorized},
+		{"unit-passive-token", `{"target": "site-x.example.com", `, http.StatusBadRequest},
+		{"unit-passive-token", `{"status": true}`, http.StatusBadRequest},
+		{"unit-passive-token", `{"target": "site-x.example.com", "status": true, "ttl": 1}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := passiveRequest(tt.token, tt.body); w.Code != tt.code {
+			t.Errorf("POST /gslb/passive %s returned %v, wanted %v: %s", tt.body, w.Code, tt.code, w.Body.String())
+		}
+	}
+
+	if !waitForStatus("passive", "site-x.example.com", true) {
+		t.Errorf("passive site-x.example.com down after a report")
+	}
+	found := fmt.Sprintf("%v", LookupBackEnd("passive.example.com", "default", false, zoneRef, 0, notrace))
+	if found != "[A 192.0.2.99]" {
+		t.Errorf("LookupBackEnd(passive.example.com) with a report, found %v", found)
+	}
+
+	// No fresh report: back to down.
+	time.Sleep(time.Duration(2500) * time.Millisecond)
+	if status, _ := GetStatus("passive", "site-x.example.com"); status != false {
+		t.Errorf("passive site-x.example.com still up after the report expired")
+	}
+	found = fmt.Sprintf("%v", LookupBackEnd("passive.example.com", "default", false, zoneRef, 0, notrace))
+	if found != "[A 192.0.2.3]" {
+		t.Errorf("LookupBackEnd(passive.example.com) after the report expired, found %v", found)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+/*
+Peer GSLB nodes.
+
+ns1 and ns2 each poll the health checks on their own, so during a partial
+outage they can hand out different answers for the same view.  Peers
+exchange their health tables over HTTP, and each node decides every
+check from all of them:
+
+[peers]
+name: ns1                            # this node; default is the hostname
+peer: [http://ns2.example.com:8080]  # the other nodes
+token: some-long-random-string       # for GET /gslb/peer/status, here and there
+policy: majority                     # majority, any-down, or local (the default: ignore peers)
+interval: 10                         # seconds between pulls
+ttl: 60                              # seconds; older peer tables are ignored
+
+Each node shares its own verdicts (after any remote probes, see probe.go),
+never the shared ones, so the nodes settle on the same answer.  With
+"majority", a tie counts as up.  A check a peer does not know about is
+decided without that peer.
+
+Each node needs its own name: a peer table under our own name (two
+nodes sharing a server.conf with one [peers] name, say) is refused.
+[probe] name is for probe agents, and not used here.
+
+Passive and composite checks are not shared (see probe.go): a passive
+report reaches only the node it was sent to.
+
+/gslb/hc shows what each peer said, and "DISAGREE" when they differ.
+The peers_counter stats count agreements, disagreements and failed
+pulls; peers_disagree is how many checks the nodes disagree on now.
+*/
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PeerDefaultInterval is how often we pull the peers' tables, if server.conf does not say.
+var PeerDefaultInterval = 10
+
+// PeerDefaultTTL is how long a peer's table counts, if server.conf does not say.
+var PeerDefaultTTL = 60
+
+var peerVotes = NewVoteBox()
+
+var statsPeers = newStat("peers")
+var peersDisagree = expvar.NewInt("peers_disagree")
+
+// peerPolicy is how the nodes combine their verdicts.
+func peerPolicy() string {
+	if policy, ok := GlobalConfig().GetSectionNameValueString("peers", "policy"); ok {
+		return toLower(policy)
+	}
+	return "local"
+}
+
+// peerName is the name of this node, to its peers.
+func peerName() string {
+	if name, ok := GlobalConfig().GetSectionNameValueString("peers", "name"); ok {
+		return name
+	}
+	return ourHostname()
+}
+
+// peerTTL is how long a peer's table counts.
+func peerTTL() time.Duration {
+	if i, ok := GlobalConfig().GetSectionNameValueInt("peers", "ttl"); ok && i > 0 {
+		return time.Duration(i) * time.Second
+	}
+	return time.Duration(PeerDefaultTTL) * time.Second
+}
+
+// peerQuorum returns how many of n nodes must say up, for the shared verdict to be up.
+func peerQuorum(policy string, n int) (int, error) {
+	switch policy {
+	case "any-down":
+		return n, nil
+	case "majority":
+		return (n + 1) / 2, nil // A tie counts as up
+	}
+	return 0, fmt.Errorf("[peers] policy %q: wanted majority, any-down or local", policy)
+}
+
+// combinePeers decides the shared verdict of a check, from ours and the peers',
+// according to [peers] policy.
+func combinePeers(service string, target string, own bool, ownErr error) (bool, error) {
+	policy := peerPolicy()
+	if policy == "local" || localOnly(service) {
+		return own, ownErr
+	}
+	votes := peerVotes.Fresh(ServiceTargetKey{service, target}, peerTTL())
+	if len(votes) == 0 {
+		return own, ownErr
+	}
+	votes[peerName()] = own
+	needed, err := peerQuorum(policy, len(votes))
+	if err != nil {
+		log.Printf("peers: %v; using our own result\n", err)
+		return own, ownErr
+	}
+
+	up := 0
+	down := []string{}
+	for node, status := range votes {
+		if status {
+			up++
+		} else {
+			down = append(down, node)
+		}
+	}
+	if up >= needed {
+		return true, nil
+	}
+	sort.Strings(down)
+	err = fmt.Errorf("%v of %v nodes up, need %v; down: %s", up, len(votes), needed, strings.Join(down, ", "))
+	if ownErr != nil {
+		err = fmt.Errorf("%v; local: %v", err, ownErr)
+	}
+	return false, err
+}
+
+// repeer recombines a check's shared verdict after a new peer table, without polling again.
+func repeer(service string, target string) {
+	HealthChecks.Lock.RLock() // RO
+	info, found := HealthChecks.Info[ServiceTargetKey{service, target}]
+	polled := found && info.Polls > 0
+	own := found && info.Own
+	HealthChecks.Lock.RUnlock() // RO
+	if !polled {
+		return // Our own first poll will count the votes
+	}
+	before := GetState(service, target)
+	status, err := combinePeers(service, target, own, nil)
+	if changed, ok := setStatus(service, target, status, false); ok {
+		announceChange(service, target, before, changed, false, status, err)
+	}
+}
+
+// ownPeerReport gathers our own verdicts (not the shared ones) for every check.
+func ownPeerReport() ProbeReport {
+	report := ProbeReport{Vantage: peerName(), Results: []ProbeResult{}}
+	HealthChecks.Lock.RLock() // RO
+	for key, info := range HealthChecks.Info {
+		if info.Polls == 0 || localOnly(key.Service) {
+			continue // Nothing to say (yet)
+		}
+		r := ProbeResult{Service: key.Service, Target: key.Target, Status: info.Own}
+		if !info.Own {
+			r.Error = info.LastError
+		}
+		report.Results = append(report.Results, r)
+	}
+	HealthChecks.Lock.RUnlock() // RO
+	sort.Slice(report.Results, func(i, j int) bool {
+		if report.Results[i].Service != report.Results[j].Service {
+			return report.Results[i].Service < report.Results[j].Service
+		}
+		return report.Results[i].Target < report.Results[j].Target
+	})
+	return report
+}
+
+// SetPeerReport stores a peer's table, counts where it agrees with ours,
+// and updates the shared verdict of every check it mentions.
+func SetPeerReport(report ProbeReport) {
+	results := []ProbeResult{}
+	for _, r := range report.Results {
+		if !localOnly(r.Service) {
+			results = append(results, r)
+		}
+	}
+	peerVotes.Set(report.Vantage, results)
+	for _, r := range results {
+		HealthChecks.Lock.RLock() // RO
+		info, found := HealthChecks.Info[ServiceTargetKey{r.Service, r.Target}]
+		polled := found && info.Polls > 0
+		own := found && info.Own
+		HealthChecks.Lock.RUnlock() // RO
+		if !polled {
+			continue
+		}
+		if r.Status == own {
+			statsPeers.Increment("agree")
+		} else {
+			statsPeers.Increment("mismatch")
+		}
+		repeer(r.Service, r.Target)
+	}
+	peersDisagree.Set(int64(countDisagreements()))
+}
+
+// peerDisagrees returns true if some fresh peer table differs from our own verdict.
+func peerDisagrees(key ServiceTargetKey, own bool) bool {
+	for _, status := range peerVotes.Fresh(key, peerTTL()) {
+		if status != own {
+			return true
+		}
+	}
+	return false
+}
+
+// countDisagreements is how many checks the nodes disagree on right now.
+func countDisagreements() int {
+	owns := make(map[ServiceTargetKey]bool)
+	HealthChecks.Lock.RLock() // RO
+	for key, info := range HealthChecks.Info {
+		if info.Polls > 0 && !localOnly(key.Service) {
+			owns[key] = info.Own
+		}
+	}
+	HealthChecks.Lock.RUnlock() // RO
+	n := 0
+	for key, own := range owns {
+		if peerDisagrees(key, own) {
+			n++
+		}
+	}
+	return n
+}
+
+// peerText describes what each node said about a check, for /gslb/hc.
+// Empty if no peer has told us about it.
+func peerText(service string, target string, own bool) string {
+	key := ServiceTargetKey{service, target}
+	votes := peerVotes.Text(key, peerTTL())
+	if len(votes) == 0 {
+		return ""
+	}
+	s := "peers[" + strings.Join(append([]string{fmt.Sprintf("%s=%v", peerName(), own)}, votes...), " ") + "]"
+	if peerDisagrees(key, own) {
+		s = s + " DISAGREE"
+	}
+	return s
+}
+
+// fetchPeerReport pulls the health table of one peer.
+func fetchPeerReport(url string, token string) (report ProbeReport, err error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(url, "/")+"/gslb/peer/status", nil)
+	if err != nil {
+		return report, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := http.Client{Timeout: time.Duration(10) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return report, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return report, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&report); err != nil {
+		return report, fmt.Errorf("%s: %v", url, err)
+	}
+	if report.Vantage == "" {
+		return report, fmt.Errorf("%s: report has no node name", url)
+	}
+	if report.Vantage == peerName() {
+		return report, fmt.Errorf("%s: node name %q is ours too; give each node its own [peers] name", url, report.Vantage)
+	}
+	return report, nil
+}
+
+// pullPeers pulls and stores the table of every [peers] peer, once.
+func pullPeers() {
+	c := GlobalConfig()
+	urls, _ := c.GetSectionNameValueStrings("peers", "peer")
+	token, _ := c.GetSectionNameValueString("peers", "token")
+	for _, url := range urls {
+		report, err := fetchPeerReport(url, token)
+		if err != nil {
+			statsPeers.Increment("error")
+			log.Printf("peers: %v\n", err)
+			continue
+		}
+		SetPeerReport(report)
+	}
+}
+
+// taskPeers pulls the peers' tables, forever.
+func taskPeers() {
+	for {
+		pullPeers()
+		interval := PeerDefaultInterval
+		if i, ok := GlobalConfig().GetSectionNameValueInt("peers", "interval"); ok && i > 0 {
+			interval = i
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// myHTTPPeerStatusHandler serves GET /gslb/peer/status, for the other nodes.
+func myHTTPPeerStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !tokenAuthorized(w, r, "peers") {
+		return
+	}
+	writeJSON(w, ownPeerReport())
+}
+
+func init() {
+	http.HandleFunc("/gslb/peer/status", myHTTPPeerStatusHandler)
+}
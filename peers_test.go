@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPeers(t *testing.T) {
+	initGlobal("t/etc")
+	AddCheck("check_unit_peer", "peer.example.com", 3600)
+	waitForPoll("check_unit_peer", "peer.example.com")
+
+	if status, _ := GetStatus("check_unit_peer", "peer.example.com"); status != true {
+		t.Errorf("check_unit_peer down before any peer reported")
+	}
+
+	// Another node, serving its table the way we do.
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gslb/peer/status" || r.Header.Get("Authorization") != "Bearer unit-peer-token" {
+			http.Error(w, "no", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, ProbeReport{Vantage: "unit-ns2", Results: []ProbeResult{
+			{Service: "check_unit_peer", Target: "peer.example.com", Status: false, Error: "timeout"},
+		}})
+	}))
+	defer peer.Close()
+
+	if _, err := fetchPeerReport(peer.URL, "wrong-token"); err == nil {
+		t.Errorf("fetchPeerReport() with the wrong token should have failed")
+	}
+	report, err := fetchPeerReport(peer.URL, "unit-peer-token")
+	if err != nil {
+		t.Fatalf("fetchPeerReport() failed: %v", err)
+	}
+
+	// "any-down": one node saying down is enough.
+	SetPeerReport(report)
+	if status, _ := GetStatus("check_unit_peer", "peer.example.com"); status != false {
+		t.Errorf("check_unit_peer up, but a peer says down (any-down)")
+	}
+	if s := dumpHealthCheckStatusAsText(); !strings.Contains(s, "peers[unit-ns1=true unit-ns2=false] DISAGREE") {
+		t.Errorf("/gslb/hc does not show the disagreement")
+	}
+	if peersDisagree.Value() < 1 {
+		t.Errorf("peers_disagree is %v, wanted at least 1", peersDisagree.Value())
+	}
+
+	// We share our own verdict, not the shared one.
+	found := false
+	for _, r := range ownPeerReport().Results {
+		if r.Service == "check_unit_peer" && r.Target == "peer.example.com" {
+			found = r.Status
+		}
+	}
+	if !found {
+		t.Errorf("ownPeerReport() does not show our own verdict for check_unit_peer")
+	}
+
+	SetPeerReport(ProbeReport{Vantage: "unit-ns2", Results: []ProbeResult{
+		{Service: "check_unit_peer", Target: "peer.example.com", Status: true},
+	}})
+	if status, _ := GetStatus("check_unit_peer", "peer.example.com"); status != true {
+		t.Errorf("check_unit_peer down, but every node says up")
+	}
+	if s := dumpHealthCheckStatusAsText(); strings.Contains(s, "unit-ns2=true] DISAGREE") {
+		t.Errorf("/gslb/hc shows a disagreement after the nodes agree")
+	}
+}
+
+func TestPeersLocalOnly(t *testing.T) {
+	initGlobal("t/etc")
+	waitForPoll("passive", "site-x.example.com")
+
+	// Another node's "no report" says nothing about a report sent to us.
+	SetPeerReport(ProbeReport{Vantage: "unit-ns2", Results: []ProbeResult{
+		{Service: "passive", Target: "site-x.example.com", Status: false},
+	}})
+	if votes := peerVotes.Text(ServiceTargetKey{"passive", "site-x.example.com"}, peerTTL()); len(votes) != 0 {
+		t.Errorf("passive site-x.example.com has peer votes %v", votes)
+	}
+	if status, _ := combinePeers("passive", "site-x.example.com", true, nil); !status {
+		t.Errorf("combinePeers(passive) went against our own result")
+	}
+	for _, r := range ownPeerReport().Results {
+		if localOnly(r.Service) {
+			t.Errorf("ownPeerReport() has %s %s, which is local only", r.Service, r.Target)
+		}
+	}
+}
+
+func TestPeerOwnName(t *testing.T) {
+	initGlobal("t/etc")
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, ProbeReport{Vantage: "unit-ns1", Results: []ProbeResult{}})
+	}))
+	defer peer.Close()
+	if _, err := fetchPeerReport(peer.URL, "unit-peer-token"); err == nil || !strings.Contains(err.Error(), "unit-ns1") {
+		t.Errorf("fetchPeerReport() of a peer with our own name: %v", err)
+	}
+	if report := ownPeerReport(); report.Vantage != "unit-ns1" {
+		t.Errorf("ownPeerReport() from %q, wanted [peers] name unit-ns1", report.Vantage)
+	}
+}
+
+func TestPeerQuorum(t *testing.T) {
+	var tests = []struct {
+		policy string
+		count  int
+		needed int
+	}{
+		{"any-down", 3, 3},
+		{"majority", 3, 2},
+		{"majority", 2, 1}, // A tie counts as up
+		{"majority", 4, 2},
+	}
+	for _, tt := range tests {
+		if needed, err := peerQuorum(tt.policy, tt.count); err != nil || needed != tt.needed {
+			t.Errorf("peerQuorum(%v, %v) wanted %v, found %v %v", tt.policy, tt.count, tt.needed, needed, err)
+		}
+	}
+	if _, err := peerQuorum("most", 3); err == nil {
+		t.Errorf("peerQuorum(most) should have failed")
+	}
+}
+
+func TestPeerStatusAuth(t *testing.T) {
+	initGlobal("t/etc")
+	for _, tt := range []struct {
+		token string
+		code  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"unit-peer-token", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/gslb/peer/status", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		myHTTPPeerStatusHandler(w, r)
+		if w.Code != tt.code {
+			t.Errorf("GET /gslb/peer/status with %q returned %v, wanted %v", tt.token, w.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+/*
+Remote probes.
+
+A mirror reachable from one name server may not be reachable from
+another continent.  The same binary, started with -probe-agent, runs
+the health checks from zone.conf (but no DNS, peers, zone transfers or
+DNSSEC key rollovers), and reports the results to the GSLB nodes over
+HTTP.  Each node then combines its own result
+with the probes' for a verdict.
+
+On the agent:
+
+[probe]
+name: europe-1                   # vantage point; default is the hostname
+report: [http://ns1.example.com:8080/gslb/probe, http://ns2.example.com:8080/gslb/probe]
+token: some-long-random-string
+interval: 30                     # seconds between reports
+
+On the GSLB nodes:
+
+[probe]
+token: some-long-random-string
+policy: at-least 2               # local (the default: ignore probes), all, any, majority, at-least N
+ttl: 90                          # seconds; older probe results are ignored
+
+A check may set its own probe_policy.  Our own poll counts as one vantage
+point.  With fewer fresh vantage points than the policy needs (the
+agents have stopped reporting, say), our own result stands.
+/gslb/hc shows what each vantage point said.
+
+Checks that only make sense where they run (passive reports, which reach
+just the node they were sent to, and composites, whose members are
+reported themselves) are not sent by agents, and go by our own result.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProbeDefaultTTL is how long a probe result counts, if server.conf does not say.
+var ProbeDefaultTTL = 90
+
+// ProbeResult is one check's result, from one vantage point.
+type ProbeResult struct {
+	Service string `json:"service"`
+	Target  string `json:"target"`
+	Status  bool   `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ProbeReport is what an agent POSTs to /gslb/probe.
+type ProbeReport struct {
+	Vantage string        `json:"vantage"`
+	Results []ProbeResult `json:"results"`
+}
+
+// probeVote is what we remember of a ProbeResult.
+type probeVote struct {
+	Status bool
+	Error  string
+	Time   time.Time
+}
+
+// VoteBox holds the latest results from other places (probes, peers), by check, then place.
+type VoteBox struct {
+	lock  sync.RWMutex
+	votes map[ServiceTargetKey]map[string]probeVote
+}
+
+// NewVoteBox returns an empty VoteBox.
+func NewVoteBox() *VoteBox {
+	return &VoteBox{votes: make(map[ServiceTargetKey]map[string]probeVote)}
+}
+
+// Set stores the results from one place.
+func (b *VoteBox) Set(from string, results []ProbeResult) {
+	now := time.Now()
+	b.lock.Lock()
+	for _, r := range results {
+		key := ServiceTargetKey{r.Service, r.Target}
+		if b.votes[key] == nil {
+			b.votes[key] = make(map[string]probeVote)
+		}
+		b.votes[key][from] = probeVote{Status: r.Status, Error: r.Error, Time: now}
+	}
+	b.lock.Unlock()
+}
+
+// Fresh returns the results for a check no older than ttl, by place.
+func (b *VoteBox) Fresh(key ServiceTargetKey, ttl time.Duration) map[string]bool {
+	ret := make(map[string]bool)
+	cutoff := time.Now().Add(-ttl)
+	b.lock.RLock()
+	for from, vote := range b.votes[key] {
+		if vote.Time.After(cutoff) {
+			ret[from] = vote.Status
+		}
+	}
+	b.lock.RUnlock()
+	return ret
+}
+
+// Text describes every result for a check ("place=bool", sorted), marking the stale ones.
+func (b *VoteBox) Text(key ServiceTargetKey, ttl time.Duration) []string {
+	ret := []string{}
+	cutoff := time.Now().Add(-ttl)
+	b.lock.RLock()
+	for from, vote := range b.votes[key] {
+		s := fmt.Sprintf("%s=%v", from, vote.Status)
+		if vote.Time.Before(cutoff) {
+			s = s + "(stale)"
+		}
+		ret = append(ret, s)
+	}
+	b.lock.RUnlock()
+	sort.Strings(ret)
+	return ret
+}
+
+var probeVotes = NewVoteBox()
+
+// probeName is the name of this vantage point.
+func probeName() string {
+	if name, ok := GlobalConfig().GetSectionNameValueString("probe", "name"); ok {
+		return name
+	}
+	return ourHostname()
+}
+
+// probePolicy is how a check combines the vantage points.
+func probePolicy(service string) string {
+	if policy, ok := checkParam(service, "probe_policy"); ok {
+		return policy
+	}
+	if policy, ok := GlobalConfig().GetSectionNameValueString("probe", "policy"); ok {
+		return policy
+	}
+	return "local"
+}
+
+// probeTTL is how long a probe result counts.
+func probeTTL() time.Duration {
+	if i, ok := GlobalConfig().GetSectionNameValueInt("probe", "ttl"); ok && i > 0 {
+		return time.Duration(i) * time.Second
+	}
+	return time.Duration(ProbeDefaultTTL) * time.Second
+}
+
+// vantageVotes returns the fresh results of every vantage point for a check,
+// with our own (local) result included.
+func vantageVotes(service string, target string, local bool) map[string]bool {
+	votes := probeVotes.Fresh(ServiceTargetKey{service, target}, probeTTL())
+	votes[probeName()] = local
+	return votes
+}
+
+// localOnly returns true for checks that the vantage points don't vote on.
+func localOnly(service string) bool {
+	return service == "passive" || isComposite(service)
+}
+
+// combineVantages decides the status of a check, from our own poll and the
+// remote probes, according to the check's probe policy.
+func combineVantages(service string, target string, local bool, localErr error) (bool, error) {
+	policy := probePolicy(service)
+	if toLower(policy) == "local" || localOnly(service) {
+		return local, localErr
+	}
+	votes := vantageVotes(service, target, local)
+	needed, err := parseQuorum(policy, len(votes))
+	if err != nil {
+		log.Printf("%s: probe policy: %v; using our own result\n", service, err)
+		return local, localErr
+	}
+	if needed > len(votes) {
+		return local, localErr // Too few probes heard from (lately) to outvote us
+	}
+	up := 0
+	down := []string{}
+	for vantage, status := range votes {
+		if status {
+			up++
+		} else {
+			down = append(down, vantage)
+		}
+	}
+	if up >= needed {
+		return true, nil
+	}
+	sort.Strings(down)
+	err = fmt.Errorf("%v of %v vantage points up, need %v; down: %s", up, len(votes), needed, strings.Join(down, ", "))
+	if localErr != nil {
+		err = fmt.Errorf("%v; local: %v", err, localErr)
+	}
+	return false, err
+}
+
+// revote recombines a check's verdict after new probe results, without polling again.
+func revote(service string, target string) {
+	HealthChecks.Lock.RLock() // RO
+	info, found := HealthChecks.Info[ServiceTargetKey{service, target}]
+	polled := found && info.Polls > 0
+	local := found && info.Local
+	HealthChecks.Lock.RUnlock() // RO
+	if !polled {
+		return // Our own first poll will count the votes
+	}
+	before := GetState(service, target)
+	status, err := combineVantages(service, target, local, nil)
+	setOwnStatus(service, target, status)
+	status, err = combinePeers(service, target, status, err)
+	if changed, ok := setStatus(service, target, status, false); ok {
+		announceChange(service, target, before, changed, false, status, err)
+	}
+}
+
+// SetProbeReport stores the results from one vantage point, and updates
+// the verdict of every check it mentions.
+func SetProbeReport(report ProbeReport) {
+	results := []ProbeResult{}
+	for _, r := range report.Results {
+		if !localOnly(r.Service) {
+			results = append(results, r) // From an older agent, perhaps
+		}
+	}
+	probeVotes.Set(report.Vantage, results)
+	for _, r := range results {
+		revote(r.Service, r.Target)
+	}
+}
+
+// vantageText describes what each vantage point said about a check, for /gslb/hc.
+// Empty if no probes have reported on it.
+func vantageText(service string, target string, local bool) string {
+	votes := probeVotes.Text(ServiceTargetKey{service, target}, probeTTL())
+	if len(votes) == 0 {
+		return ""
+	}
+	return "vantage[" + strings.Join(append([]string{fmt.Sprintf("%s=%v", probeName(), local)}, votes...), " ") + "]"
+}
+
+// myHTTPProbeHandler serves POST /gslb/probe, for probe agents.
+func myHTTPProbeHandler(w http.ResponseWriter, r *http.Request) {
+	if !tokenAuthorized(w, r, "probe") {
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var report ProbeReport
+	if err := json.NewDecoder(io.LimitReader(r.Body, 16<<20)).Decode(&report); err != nil {
+		http.Error(w, "bad report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.Vantage == "" {
+		http.Error(w, "report has no vantage", http.StatusBadRequest)
+		return
+	}
+	SetProbeReport(report)
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, fmt.Sprintf("%s: %v results\n", report.Vantage, len(report.Results)))
+}
+
+// localProbeReport gathers our own results (not the combined verdicts) for every check.
+func localProbeReport() ProbeReport {
+	report := ProbeReport{Vantage: probeName(), Results: []ProbeResult{}}
+	HealthChecks.Lock.RLock() // RO
+	for key, info := range HealthChecks.Info {
+		if info.Polls == 0 || localOnly(key.Service) {
+			continue // Nothing to say (yet)
+		}
+		r := ProbeResult{Service: key.Service, Target: key.Target, Status: info.Local}
+		if !info.Local {
+			r.Error = info.LastError
+		}
+		report.Results = append(report.Results, r)
+	}
+	HealthChecks.Lock.RUnlock() // RO
+	return report
+}
+
+// sendProbeReport POSTs a report to one GSLB node.
+func sendProbeReport(url string, token string, report ProbeReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := http.Client{Timeout: time.Duration(10) * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// runProbeAgent reports our health check results to every [probe] report URL, forever.
+func runProbeAgent() {
+	for {
+		c := GlobalConfig()
+		urls, _ := c.GetSectionNameValueStrings("probe", "report")
+		token, _ := c.GetSectionNameValueString("probe", "token")
+		if len(urls) == 0 {
+			log.Printf("probe agent: no [probe] report URLs in server.conf\n")
+		}
+		report := localProbeReport()
+		for _, url := range urls {
+			if err := sendProbeReport(url, token, report); err != nil {
+				log.Printf("probe agent: %v\n", err)
+			}
+		}
+		interval := 30
+		if i, ok := c.GetSectionNameValueInt("probe", "interval"); ok && i > 0 {
+			interval = i
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+func init() {
+	http.HandleFunc("/gslb/probe", myHTTPProbeHandler)
+}
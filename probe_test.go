@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func probeRequest(token string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/gslb/probe", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	myHTTPProbeHandler(w, r)
+	return w
+}
+
+func TestProbeVantages(t *testing.T) {
+	initGlobal("t/etc")
+	AddCheck("check_unit_probe", "probe.example.com", 3600)
+	waitForPoll("check_unit_probe", "probe.example.com")
+
+	// "at-least 2", but no probe has reported: our own result stands.
+	if status, _ := GetStatus("check_unit_probe", "probe.example.com"); status != true {
+		t.Errorf("check_unit_probe down with no probes, and up locally")
+	}
+
+	var tests = []struct {
+		token  string
+		body   string
+		code   int
+		status bool
+	}{
+		{"", `{"vantage": "europe", "results": [{"service": "check_unit_probe", "target": "probe.example.com", "status": true}]}`, http.StatusUnauthorized, true},
+		{"unit-probe-token", `{"results": []}`, http.StatusBadRequest, true},
+		{"unit-probe-token", `{"vantage": "europe", "results": [{"service": "check_unit_probe", "target": "probe.example.com", "status": true}]}`, http.StatusOK, true},
+		{"unit-probe-token", `{"vantage": "europe", "results": [{"service": "check_unit_probe", "target": "probe.example.com", "status": false}]}`, http.StatusOK, false},
+		{"unit-probe-token", `{"vantage": "asia", "results": [{"service": "check_unit_probe", "target": "probe.example.com", "status": true}]}`, http.StatusOK, true},
+		{"unit-probe-token", `{"vantage": "asia", "results": [{"service": "check_unit_probe", "target": "probe.example.com", "status": false, "error": "timeout"}]}`, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		if w := probeRequest(tt.token, tt.body); w.Code != tt.code {
+			t.Errorf("POST /gslb/probe %s returned %v, wanted %v: %s", tt.body, w.Code, tt.code, w.Body.String())
+		}
+		if status, _ := GetStatus("check_unit_probe", "probe.example.com"); status != tt.status {
+			t.Errorf("after %s, status %v, wanted %v", tt.body, status, tt.status)
+		}
+	}
+
+	if s := dumpHealthCheckStatusAsText(); !strings.Contains(s, "vantage[unit-local=true asia=false europe=false]") {
+		t.Errorf("/gslb/hc does not show the vantage points")
+	}
+
+	found := false
+	for _, r := range localProbeReport().Results {
+		if r.Service == "check_unit_probe" && r.Target == "probe.example.com" {
+			found = r.Status // Our own result, not the verdict
+		}
+	}
+	if !found {
+		t.Errorf("localProbeReport() missing our own check_unit_probe result")
+	}
+}
+
+func TestParseQuorum(t *testing.T) {
+	var tests = []struct {
+		mode   string
+		count  int
+		needed int
+	}{
+		{"all", 3, 3},
+		{"any", 3, 1},
+		{"majority", 3, 2},
+		{"majority", 4, 3},
+		{"at-least 2", 3, 2},
+	}
+	for _, tt := range tests {
+		if needed, err := parseQuorum(tt.mode, tt.count); err != nil || needed != tt.needed {
+			t.Errorf("parseQuorum(%v, %v) wanted %v, found %v %v", tt.mode, tt.count, tt.needed, needed, err)
+		}
+	}
+	if _, err := parseQuorum("most", 3); err == nil {
+		t.Errorf("parseQuorum(most) should have failed")
+	}
+}
+
+func TestProbeLocalOnly(t *testing.T) {
+	initGlobal("t/etc")
+	waitForPoll("passive", "site-x.example.com")
+	for service, want := range map[string]bool{"passive": true, "check_unit_follow": true, "check_unit_probe": false, "check_true": false} {
+		if found := localOnly(service); found != want {
+			t.Errorf("localOnly(%s) wanted %v found %v", service, want, found)
+		}
+	}
+
+	for _, r := range localProbeReport().Results {
+		if localOnly(r.Service) {
+			t.Errorf("localProbeReport() has %s %s, which is local only", r.Service, r.Target)
+		}
+	}
+
+	// An agent's (failed) passive result does not count.
+	body := `{"vantage": "europe", "results": [{"service": "passive", "target": "site-x.example.com", "status": false}]}`
+	if w := probeRequest("unit-probe-token", body); w.Code != http.StatusOK {
+		t.Errorf("POST /gslb/probe %s returned %v: %s", body, w.Code, w.Body.String())
+	}
+	if votes := probeVotes.Text(ServiceTargetKey{"passive", "site-x.example.com"}, probeTTL()); len(votes) != 0 {
+		t.Errorf("passive site-x.example.com has probe votes %v", votes)
+	}
+}
+
+func TestProbeStale(t *testing.T) {
+	initGlobal("t/etc")
+	key := ServiceTargetKey{"check_unit_probe", "stale.example.com"}
+	probeVotes.Set("europe", []ProbeResult{{Service: key.Service, Target: key.Target, Status: false}})
+	probeVotes.Set("asia", []ProbeResult{{Service: key.Service, Target: key.Target, Status: false}})
+	if status, _ := combineVantages(key.Service, key.Target, true, nil); status {
+		t.Errorf("combineVantages() up, with two fresh probes down")
+	}
+
+	// The probes stop reporting: at-least 2 can't be had, so our own result stands.
+	probeVotes.lock.Lock()
+	for from, vote := range probeVotes.votes[key] {
+		vote.Time = vote.Time.Add(-2 * probeTTL())
+		probeVotes.votes[key][from] = vote
+	}
+	probeVotes.lock.Unlock()
+	if status, err := combineVantages(key.Service, key.Target, true, nil); !status {
+		t.Errorf("combineVantages() down with only stale probes: %v", err)
+	}
+	if status, _ := combineVantages(key.Service, key.Target, false, nil); status {
+		t.Errorf("combineVantages() up with only stale probes, and down locally")
+	}
+}
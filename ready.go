@@ -0,0 +1,111 @@
+package main
+
+/*
+Startup readiness.
+
+Every health check starts out DOWN, and stays that way until it has
+been polled at least once.  If we answer DNS before then, every HC
+line in zone.conf looks dead; and we hand out the "everything failed"
+answers until the checks catch up.
+
+startDNS is therefore held back until every registered check has
+finished one poll, or until a timeout passes (whichever is first).
+A probe agent (which serves no DNS) likewise holds back its first
+report, and is ready once its checks have polled.
+
+[server]
+ready_timeout: 30
+
+/gslb/live  answers 200 as long as the process is running.
+/gslb/ready answers 200 once the DNS listeners are bound (or, for a
+probe agent, once the checks have polled), 503 until then.
+*/
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ReadyDefaultTimeout is how long we wait for the first round of health checks
+// if server.conf does not say otherwise.
+var ReadyDefaultTimeout = time.Duration(30) * time.Second
+
+// readyState is 1 once we have decided to answer DNS queries.
+var readyState int32
+
+// IsReady reports whether we are answering DNS queries (or probing, for an agent).
+func IsReady() bool {
+	return atomic.LoadInt32(&readyState) == 1
+}
+
+// setReady marks the server as ready to answer.
+func setReady() {
+	atomic.StoreInt32(&readyState, 1)
+}
+
+// HealthChecksPolled returns how many of the registered health checks have
+// finished at least one poll, and how many checks are registered in total.
+func HealthChecksPolled() (polled int, total int) {
+	HealthChecks.Lock.RLock() // RO
+	for _, info := range HealthChecks.Info {
+		total++
+		if info.Polls > 0 {
+			polled++
+		}
+	}
+	HealthChecks.Lock.RUnlock() // RO
+	return polled, total
+}
+
+// readyTimeout returns the configured wait for the first round of health checks.
+func readyTimeout() time.Duration {
+	if secs, ok := GlobalConfig().GetSectionNameValueInt("server", "ready_timeout"); ok {
+		return time.Duration(secs) * time.Second
+	}
+	return ReadyDefaultTimeout
+}
+
+// waitForReady blocks until every registered health check has been polled
+// at least once, or the timeout passes.  Either way, the caller goes ahead
+// (and calls setReady once it is serving).  Returns true if all checks
+// were polled in time.
+func waitForReady(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		polled, total := HealthChecksPolled()
+		if polled >= total {
+			log.Printf("waitForReady: %v of %v health checks polled\n", polled, total)
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Printf("waitForReady: timed out with %v of %v health checks polled, going ahead anyways\n", polled, total)
+			return false
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+}
+
+func myHTTPLiveHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "live\n")
+}
+
+func myHTTPReadyHandler(w http.ResponseWriter, r *http.Request) {
+	polled, total := HealthChecksPolled()
+	w.Header().Set("Content-Type", "text/plain")
+	if IsReady() {
+		io.WriteString(w, fmt.Sprintf("ready %v/%v\n", polled, total))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, fmt.Sprintf("not ready %v/%v\n", polled, total))
+}
+
+func init() {
+	http.HandleFunc("/gslb/live", myHTTPLiveHandler)
+	http.HandleFunc("/gslb/ready", myHTTPReadyHandler)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitForReady(t *testing.T) {
+	initGlobal("t/etc")
+
+	atomic.StoreInt32(&readyState, 0)
+	AddCheck("check_true", "ready.example.com", 1)
+	if ok := waitForReady(time.Duration(5) * time.Second); ok != true {
+		polled, total := HealthChecksPolled()
+		t.Fatalf("waitForReady() timed out, %v of %v polled", polled, total)
+	}
+
+	// Not until the DNS listeners are up.
+	w := httptest.NewRecorder()
+	myHTTPReadyHandler(w, httptest.NewRequest("GET", "/gslb/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/gslb/ready before setReady() returned %v, wanted %v", w.Code, http.StatusServiceUnavailable)
+	}
+
+	setReady() // As main does, once serving
+	if IsReady() != true {
+		t.Fatalf("IsReady() false after setReady()")
+	}
+
+	w = httptest.NewRecorder()
+	myHTTPReadyHandler(w, httptest.NewRequest("GET", "/gslb/ready", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/gslb/ready returned %v, wanted %v", w.Code, http.StatusOK)
+	}
+}
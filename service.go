@@ -17,10 +17,62 @@ type ServiceTargetKey struct {
 	Target  string
 }
 
+// CheckInfo holds the bookkeeping for a service check, beyond the simple up/down status.
+type CheckInfo struct {
+	Polls      int             // Number of completed polls; zero until the first poll finishes
+	Addrs      map[string]bool // Per-address status, for targets we know the A/AAAA records of
+	Latency    time.Duration   // How long the last successful poll took
+	LatencyAvg time.Duration   // Moving average of Latency
+	Degraded   bool            // LatencyAvg is over the check's degraded_ms threshold
+
+	Recovered map[string]time.Time // When the target ("") or an address came back up, for slow start
+
+	Output map[string]string // Output captured from the last poll, by address ("" for the target); external commands only
+
+	wake chan bool // Send to poll now, rather than at the next interval; see wakeCheck
+
+	Local     bool          // Our own poll's verdict; Status may differ, with remote probes
+	Own       bool          // Our verdict with remote probes, before the peers have their say
+	Interval  int           // Seconds between polls
+	Changed   time.Time     // When the state (up, degraded, down) last changed
+	LastState string        // The state after the last poll, for Changed
+	LastError string        // Error from the last poll; "" if it had none
+	Passes    int           // Consecutive polls up
+	Fails     int           // Consecutive polls down
+	History   []CheckResult // The last few polls, oldest first; see hcapi.go
+}
+
+// HealthState is the tri-state view of a check: down, degraded (up, but slow), or up.
+type HealthState int
+
+// The health states, from worst to best.
+const (
+	StateDown HealthState = iota
+	StateDegraded
+	StateUp
+)
+
+func (s HealthState) String() string {
+	switch s {
+	case StateUp:
+		return "up"
+	case StateDegraded:
+		return "degraded"
+	}
+	return "down"
+}
+
+// LatencyWeight is how much each new poll counts towards the moving average latency.
+var LatencyWeight = 0.3
+
 // Checks is the structure that holds the global service checks plus a mutex for accessing
 type Checks struct {
 	Lock   sync.RWMutex
 	Status map[ServiceTargetKey]bool
+	Info   map[ServiceTargetKey]*CheckInfo
+
+	Overrides map[string]*Override      // Operator overrides, by target; see admin.go
+	Ramping   map[ServiceTargetKey]bool // Checks with something in slow start; see slowstart.go
 }
 
 // HealthChecks contains the current status of all backgrounded health checks.
@@ -29,6 +81,9 @@ var HealthChecks Checks
 
 func init() {
 	HealthChecks.Status = make(map[ServiceTargetKey]bool)
+	HealthChecks.Info = make(map[ServiceTargetKey]*CheckInfo)
+	HealthChecks.Overrides = make(map[string]*Override)
+	HealthChecks.Ramping = make(map[ServiceTargetKey]bool)
 }
 
 // AddCheck starts a particular service check, against a specific target; with checks every "time" (give or take a random amount)
@@ -44,7 +99,9 @@ func AddCheck(service string, target string, secs int) (exists bool) {
 	}
 	if exists == false {
 		HealthChecks.Status[ServiceTargetKey{service, target}] = false
-		go backgroundServiceCheck(service, target, secs)
+		wake := make(chan bool, 1)
+		HealthChecks.Info[ServiceTargetKey{service, target}] = &CheckInfo{Interval: secs, wake: wake}
+		go backgroundServiceCheck(service, target, secs, wake)
 	}
 	HealthChecks.Lock.Unlock() //RW
 	return exists
@@ -52,47 +109,281 @@ func AddCheck(service string, target string, secs int) (exists bool) {
 
 // backgroundServiceCheck will start monitoring a given service for a specifieid target.
 // The interval must be specified (in go's time.Time format).
-func backgroundServiceCheck(service string, target string, secs int) {
+// Anything sent to wake cuts the wait for the next poll short.
+func backgroundServiceCheck(service string, target string, secs int, wake chan bool) {
 	t := time.Duration(secs) * time.Second
+	time.Sleep(staggerDelay()) // Don't start hundreds of checks at once
 	for {
-		// Get the latest debug flag.
-		status, err := dispatchServiceCheck(service, target)
-		changed, ok := SetStatus(service, target, status)
+		if !runServiceCheck(service, target) {
+			return // Exit goroutine, we have no more work.
+		}
+		SleepWithVarianceOrWake(t, wake)
 
-		// Make some noise about it.
-		if ok {
-			if changed {
-				ClearCaches("health check status changed")
-				log.Printf("service %s target %s status %v changed %v err %v\n", service, target, status, changed, err)
+	}
+}
 
-			}
-		} else {
-			Debugf("Lost our place! service %s target %s status %v changed %v err %v\n", service, target, status, changed, err)
-			return // Exit goroutine, we have no more work.
+// wakeCheck has a check poll again now, rather than at its next interval.
+// Only checks started by AddCheck can be woken.
+func wakeCheck(service string, target string) {
+	HealthChecks.Lock.RLock() // RO
+	info, ok := HealthChecks.Info[ServiceTargetKey{service, target}]
+	HealthChecks.Lock.RUnlock() // RO
+	if !ok || info.wake == nil {
+		return
+	}
+	select {
+	case info.wake <- true:
+	default: // Already due to wake up
+	}
+}
+
+// runServiceCheck polls a service once, and records the outcome.
+// Returns false if the check is not (or no longer) registered.
+func runServiceCheck(service string, target string) bool {
+	composite := isComposite(service) // No network traffic of its own; and it may wait on its members' polls
+	external := isExec(service)
+	if external {
+		execAcquire() // Before the poll slot, so waiting here holds up no other check
+	}
+	if !composite {
+		pollAcquire()
+	}
+	status, addrs, latency, err := pollServiceCheck(service, target)
+	if !composite {
+		pollRelease()
+	}
+	if external {
+		execRelease()
+	}
+	before, firstPoll := GetState(service, target), pollCount(service, target) == 0
+	setLocalStatus(service, target, status)
+	status, err = combineVantages(service, target, status, err) // Remote probes may disagree
+	setOwnStatus(service, target, status)
+	status, err = combinePeers(service, target, status, err) // So may the other GSLB nodes
+	changed, ok := SetStatus(service, target, status)
+	if SetAddressStatus(service, target, addrs) {
+		changed = true
+	}
+	if status && SetLatency(service, target, latency) {
+		changed = true
+	}
+	recordResult(service, target, status, latency, err)
+
+	// Make some noise about it.
+	if !ok {
+		Debugf("Lost our place! service %s target %s status %v changed %v err %v\n", service, target, status, changed, err)
+		return false
+	}
+	announceChange(service, target, before, changed, firstPoll, status, err)
+	return true
+}
+
+// announceChange clears the caches and tells everyone (log, events,
+// notifiers) about a change to a check.
+func announceChange(service string, target string, before HealthState, changed bool, firstPoll bool, status bool, err error) {
+	if changed {
+		ClearCaches("health check status changed")
+		log.Printf("service %s target %s status %v changed %v err %v\n", service, target, status, changed, err)
+		wakeComposites(service, target)
+	}
+	if after := GetState(service, target); after != before {
+		e := Event{Kind: "health", Service: service, Target: target, Old: before.String(), New: after.String(), Time: time.Now().UTC()}
+		if err != nil {
+			e.Error = err.Error()
+		}
+		Publish(e)
+		if !firstPoll {
+			Notify(e)
 		}
-		SleepWithVariance(t)
+		notifyPools(service, target, firstPoll)
+	}
+}
 
+// pollServiceCheck runs one round of a service check against a target.
+// If we know the target's A/AAAA records, every address is checked on its
+// own; the target is up if any of its addresses are up.  Otherwise
+// the target is checked by name, and addrs will be nil.
+// latency is that of the slowest address that passed.
+func pollServiceCheck(service string, target string) (status bool, addrs map[string]bool, latency time.Duration, err error) {
+	list := []string{}
+	if checkPerAddress(service) {
+		list = LookupAddresses(target)
+	}
+	if len(list) == 0 {
+		start := time.Now()
+		status, err = dispatchServiceCheck(service, target, "")
+		return status, nil, time.Since(start), err
 	}
+	addrs = make(map[string]bool, len(list))
+	for _, addr := range list {
+		start := time.Now()
+		up, e := dispatchServiceCheck(service, target, addr)
+		if took := time.Since(start); up && took > latency {
+			latency = took
+		}
+		addrs[addr] = up
+		status = status || up
+		if e != nil && err == nil {
+			err = fmt.Errorf("%s: %v", addr, e) // Keep the first error
+		}
+	}
+	return status, addrs, latency, err
 }
 
-// GetStatus gets the status of a service for a given target.
+// GetStatus gets the status of a service for a given target,
+// as changed by any operator override (force-up, force-down).
 // Use only if "ok", otherwise assume that the status is not (yet?) recorded.
 func GetStatus(service string, target string) (status bool, ok bool) {
 	HealthChecks.Lock.RLock()                                           // RO
 	check, ok := HealthChecks.Status[ServiceTargetKey{service, target}] // Get old status
+	check = HealthChecks.Overrides[overrideKey(target)].apply(check)    // Operator knows best
 	HealthChecks.Lock.RUnlock()                                         // RO
 	return check, ok                                                    // Let the caller know the old status
 }
 
 // SetStatus puts the status of a service for a given target.
 // Returns "changed", indicating if the new value is different from the old value.
+// Each call counts as one completed poll, for readiness purposes.
 // Use only if "ok".
 func SetStatus(service string, target string, status bool) (changed bool, ok bool) {
+	return setStatus(service, target, status, true)
+}
+
+// setStatus is SetStatus; "poll" says whether this counts as a completed poll,
+// or is just a new verdict (from remote probes) on the last one.
+func setStatus(service string, target string, status bool, poll bool) (changed bool, ok bool) {
 	HealthChecks.Lock.Lock()                                          // RW
 	old, ok := HealthChecks.Status[ServiceTargetKey{service, target}] // Get old status
 	HealthChecks.Status[ServiceTargetKey{service, target}] = status   // Set status
-	HealthChecks.Lock.Unlock()                                        // RW
-	return old != status, ok                                          // Let the caller know if things "changed"
+	if info, found := HealthChecks.Info[ServiceTargetKey{service, target}]; found {
+		if ok && !old && status && info.Polls > 0 {
+			markRecovered(service, target, info, "") // Back from the dead, not just starting up
+		}
+		if poll {
+			info.Polls++ // One more poll finished
+		}
+	}
+	HealthChecks.Lock.Unlock() // RW
+	return old != status, ok   // Let the caller know if things "changed"
+}
+
+// setLocalStatus records what our own poll said, before any remote probes have their say.
+func setLocalStatus(service string, target string, status bool) {
+	HealthChecks.Lock.Lock() // RW
+	if info, found := HealthChecks.Info[ServiceTargetKey{service, target}]; found {
+		info.Local = status
+	}
+	HealthChecks.Lock.Unlock() // RW
+}
+
+// setOwnStatus records our verdict, before the peers have their say.
+func setOwnStatus(service string, target string, status bool) {
+	HealthChecks.Lock.Lock() // RW
+	if info, found := HealthChecks.Info[ServiceTargetKey{service, target}]; found {
+		info.Own = status
+	}
+	HealthChecks.Lock.Unlock() // RW
+}
+
+// pollCount returns how many polls of a check have finished.
+func pollCount(service string, target string) int {
+	HealthChecks.Lock.RLock() // RO
+	defer HealthChecks.Lock.RUnlock()
+	if info, ok := HealthChecks.Info[ServiceTargetKey{service, target}]; ok {
+		return info.Polls
+	}
+	return 0
+}
+
+// GetAddressStatus gets the status of a single address of a target.
+// Use only if "ok"; otherwise the target is not being checked per address,
+// (or not for this address) and only GetStatus applies.
+func GetAddressStatus(service string, target string, addr string) (status bool, ok bool) {
+	HealthChecks.Lock.RLock() // RO
+	if info, found := HealthChecks.Info[ServiceTargetKey{service, target}]; found && info.Addrs != nil {
+		status, ok = info.Addrs[addr]
+	}
+	HealthChecks.Lock.RUnlock() // RO
+	return status, ok
+}
+
+// SetAddressStatus replaces the per-address status of a target.
+// A nil map means the target is not checked per address.
+// Only checks started by AddCheck are updated.
+// Returns "changed", if any address changed status (or appeared/disappeared).
+func SetAddressStatus(service string, target string, addrs map[string]bool) (changed bool) {
+	HealthChecks.Lock.Lock() // RW
+	info, found := HealthChecks.Info[ServiceTargetKey{service, target}]
+	if !found {
+		HealthChecks.Lock.Unlock() // RW
+		return false               // Not a check we started; nothing to update
+	}
+	if len(info.Addrs) != len(addrs) {
+		changed = true
+	}
+	for addr, status := range addrs {
+		if old, ok := info.Addrs[addr]; !ok || old != status {
+			changed = true
+			if ok && status {
+				markRecovered(service, target, info, addr)
+			}
+		}
+	}
+	info.Addrs = addrs
+	HealthChecks.Lock.Unlock() // RW
+	return changed
+}
+
+// SetCheckOutput saves the output of the latest poll of a target (or one
+// of its addresses), for /gslb/hc.
+// Only checks started by AddCheck are updated.
+func SetCheckOutput(service string, target string, addr string, output string) {
+	HealthChecks.Lock.Lock() // RW
+	if info, found := HealthChecks.Info[ServiceTargetKey{service, target}]; found {
+		if info.Output == nil {
+			info.Output = make(map[string]string)
+		}
+		info.Output[addr] = output
+	}
+	HealthChecks.Lock.Unlock() // RW
+}
+
+// SetLatency records how long a successful poll took, and updates the moving
+// average.  Checks with a "degraded_ms" parameter are degraded while the
+// average is over that many milliseconds.
+// Only checks started by AddCheck are updated.
+// Returns "changed", if the check went into or out of degraded.
+func SetLatency(service string, target string, latency time.Duration) (changed bool) {
+	threshold := time.Duration(checkParamInt(service, "degraded_ms", 0)) * time.Millisecond
+	HealthChecks.Lock.Lock() // RW
+	if info, found := HealthChecks.Info[ServiceTargetKey{service, target}]; found {
+		if info.LatencyAvg == 0 {
+			info.LatencyAvg = latency // First sample
+		} else {
+			info.LatencyAvg = time.Duration(LatencyWeight*float64(latency) + (1-LatencyWeight)*float64(info.LatencyAvg))
+		}
+		info.Latency = latency
+		degraded := threshold > 0 && info.LatencyAvg > threshold
+		changed = degraded != info.Degraded
+		info.Degraded = degraded
+	}
+	HealthChecks.Lock.Unlock() // RW
+	return changed
+}
+
+// GetState gets the tri-state health of a service for a given target.
+// Targets that are not (yet?) checked are down.
+func GetState(service string, target string) HealthState {
+	HealthChecks.Lock.RLock() // RO
+	defer HealthChecks.Lock.RUnlock()
+	key := ServiceTargetKey{service, target}
+	if !HealthChecks.Overrides[overrideKey(target)].apply(HealthChecks.Status[key]) {
+		return StateDown
+	}
+	if info, ok := HealthChecks.Info[key]; ok && info.Degraded {
+		return StateDegraded
+	}
+	return StateUp
 }
 
 func empty(service string, target string, status bool) {
@@ -104,8 +395,43 @@ func dumpHealthCheckStatusAsText() string {
 	// Copy the status, with as minimal time as possible inside the lock
 	HealthChecks.Lock.Lock() // RW
 	for key, val := range HealthChecks.Status {
-		s := fmt.Sprintf("%s %s: %v\n", key.Service, key.Target, val)
-		ret = append(ret, s)
+		checked := val
+		o := HealthChecks.Overrides[overrideKey(key.Target)]
+		val = o.apply(val)
+		s := fmt.Sprintf("%s %s: %v", key.Service, key.Target, val)
+		if info, ok := HealthChecks.Info[key]; ok {
+			state := StateDown
+			if val {
+				state = StateUp
+				if info.Degraded {
+					state = StateDegraded
+				}
+			}
+			s = s + fmt.Sprintf(" state=%v latency=%v avg=%v", state, info.Latency.Round(time.Millisecond), info.LatencyAvg.Round(time.Millisecond))
+		}
+		if info, ok := HealthChecks.Info[key]; ok && len(info.Addrs) > 0 {
+			addrs := make([]string, 0, len(info.Addrs))
+			for addr, up := range info.Addrs {
+				addrs = append(addrs, fmt.Sprintf("%s=%v", addr, up))
+			}
+			sort.Strings(addrs)
+			s = s + " [" + strings.Join(addrs, " ") + "]"
+		}
+		if o != nil && o.Active() {
+			s = s + fmt.Sprintf(" OVERRIDE %v (checked %v)", *o, checked)
+		}
+		if info, ok := HealthChecks.Info[key]; ok {
+			if v := vantageText(key.Service, key.Target, info.Local); v != "" {
+				s = s + " " + v
+			}
+			if v := peerText(key.Service, key.Target, info.Own); v != "" {
+				s = s + " " + v
+			}
+		}
+		if info, ok := HealthChecks.Info[key]; ok {
+			s = s + outputText(info.Output)
+		}
+		ret = append(ret, s+"\n")
 	}
 	HealthChecks.Lock.Unlock() // RW
 	sort.Strings(ret)
@@ -113,6 +439,27 @@ func dumpHealthCheckStatusAsText() string {
 	return retStr
 }
 
+// outputText is the saved output of a check, indented under it, one address at a time.
+func outputText(output map[string]string) string {
+	addrs := make([]string, 0, len(output))
+	for addr := range output {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	s := ""
+	for _, addr := range addrs {
+		text := output[addr]
+		if text == "" {
+			continue
+		}
+		if addr != "" {
+			text = addr + ": " + text
+		}
+		s = s + "\n    " + strings.Replace(text, "\n", "\n    ", -1)
+	}
+	return s
+}
+
 func myHTTPHealthHandler(w http.ResponseWriter, r *http.Request) {
 	s := dumpHealthCheckStatusAsText()
 	w.Header().Set("Content-Type", "text/plain")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 	"time"
 )
@@ -69,3 +70,52 @@ func BenchmarkEmptyFunction(b *testing.B) {
 		empty("x", "y", true)
 	}
 }
+
+func TestDegraded(t *testing.T) {
+	initGlobal("t/etc")
+	zoneRef := GlobalZoneData()
+	notrace := NewLookupTraceOff()
+	waitForPoll("check_unit_latency", "one.example.com")
+	waitForPoll("check_unit_latency", "two.example.com")
+
+	var tests = []struct {
+		one time.Duration
+		two time.Duration
+		out string
+	}{
+		{10 * time.Millisecond, 10 * time.Millisecond, "[A 192.0.2.1 A 192.0.2.2]"},
+		{5 * time.Second, 10 * time.Millisecond, "[A 192.0.2.2]"},       // Slow one, skipped
+		{5 * time.Second, 5 * time.Second, "[A 192.0.2.1 A 192.0.2.2]"}, // All slow, better than nothing
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ { // Enough to settle the moving average
+			SetLatency("check_unit_latency", "one.example.com", tt.one)
+			SetLatency("check_unit_latency", "two.example.com", tt.two)
+		}
+		ClearCaches("unit testing TestDegraded")
+		found := fmt.Sprintf("%v", LookupBackEnd("degraded.example.com", "default", false, zoneRef, 0, notrace))
+		if found != tt.out {
+			t.Errorf("LookupBackEnd(degraded.example.com) with latency %v/%v, wanted %v found %v", tt.one, tt.two, tt.out, found)
+		}
+	}
+	// The fast one drained by an operator: the slow one is all we have.
+	for i := 0; i < 20; i++ {
+		SetLatency("check_unit_latency", "one.example.com", 5*time.Second)
+		SetLatency("check_unit_latency", "two.example.com", 10*time.Millisecond)
+	}
+	lines, _ := zoneRef.GetSectionNameValueStrings("default", "degraded.example.com")
+	SetOverride("two.example.com", "drain", "unit testing", time.Time{})
+	healthy := healthyHC(lines)
+	found := fmt.Sprintf("%v", LookupBackEnd("degraded.example.com", "default", false, zoneRef, 0, notrace))
+	ClearOverride("two.example.com")
+	if healthy || found != "[A 192.0.2.1]" {
+		t.Errorf("degraded.example.com with the fast one drained: healthyHC %v, LookupBackEnd %v; wanted false, [A 192.0.2.1]", healthy, found)
+	}
+
+	if state := GetState("check_unit_latency", "one.example.com"); state != StateDegraded {
+		t.Errorf("GetState(check_unit_latency, one.example.com) wanted degraded, found %v", state)
+	}
+	if state := GetState("check_false", "gigo.com"); state != StateDown {
+		t.Errorf("GetState(check_false, gigo.com) wanted down, found %v", state)
+	}
+}
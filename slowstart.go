@@ -0,0 +1,207 @@
+package main
+
+/*
+Slow start.
+
+When a target recovers, putting it straight back into every answer can
+swamp it (cold caches and all).  With a slow_start parameter (in seconds)
+on the check, its share of answers instead grows linearly over that
+window:
+
+[check_mirror]
+slow_start: 300
+
+Addresses checked one at a time ramp up on their own.  A check coming
+up for the first time (at startup) does not count as a recovery.
+
+While anything is ramping up, answers for a name are built as
+SlowStartSteps variants; a ramping address is left out of the variants
+it has not yet earned.  Each variant is equally likely to be handed out.
+At every step of the ramp, the cached answers built from variants (and
+only those) are dropped, to be built again with the new weights.
+*/
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SlowStartSteps is how many answer variants we build while something is ramping up.
+var SlowStartSteps = 10
+
+// slowStartWindow is how long a target of this service takes to ramp up after recovering.
+// Zero means no ramp.
+func slowStartWindow(service string) time.Duration {
+	return time.Duration(checkParamInt(service, "slow_start", 0)) * time.Second
+}
+
+// slowStartCached lists the cached answers (CacheMsgs) that were built from
+// variants, and so must be built again at the next step of the ramp.
+var slowStartCached = make(map[QueryInfo]bool)
+var slowStartCachedLock sync.Mutex
+
+// markRecovered notes that a target ("" for the whole target) or one of its
+// addresses just came back up, and starts refreshing the answers while it ramps.
+// Must be called with HealthChecks.Lock held.
+func markRecovered(service string, target string, info *CheckInfo, addr string) {
+	window := slowStartWindow(service)
+	if window <= 0 {
+		return
+	}
+	if info.Recovered == nil {
+		info.Recovered = make(map[string]time.Time)
+	}
+	info.Recovered[addr] = time.Now()
+	HealthChecks.Ramping[ServiceTargetKey{service, target}] = true
+	go slowStartRefresh(window)
+}
+
+// slowStartRefresh drops the cached answers built from variants at every step
+// of a ramp, so that they pick up the new weights.  Once done, the check is no
+// longer looked at by slowStartWeights.
+func slowStartRefresh(window time.Duration) {
+	step := window / time.Duration(SlowStartSteps)
+	for i := 0; i < SlowStartSteps; i++ {
+		time.Sleep(step)
+		slowStartForget()
+	}
+	slowStartPrune()
+}
+
+// slowStartRemember notes a cached answer that was built from variants.
+func slowStartRemember(QI QueryInfo) {
+	slowStartCachedLock.Lock()
+	slowStartCached[QI] = true
+	slowStartCachedLock.Unlock()
+}
+
+// slowStartForget drops every cached answer that was built from variants.
+func slowStartForget() {
+	slowStartCachedLock.Lock()
+	cached := slowStartCached
+	slowStartCached = make(map[QueryInfo]bool)
+	slowStartCachedLock.Unlock()
+	for QI := range cached {
+		CacheMsgs.Delete(QI)
+	}
+}
+
+// slowStartPrune forgets the ramps that are over.
+func slowStartPrune() {
+	now := time.Now()
+	HealthChecks.Lock.Lock() // RW
+	for key := range HealthChecks.Ramping {
+		info, ok := HealthChecks.Info[key]
+		if ok {
+			window := slowStartWindow(key.Service)
+			for addr, since := range info.Recovered {
+				if now.Sub(since) >= window {
+					delete(info.Recovered, addr)
+				}
+			}
+		}
+		if !ok || len(info.Recovered) == 0 {
+			delete(HealthChecks.Ramping, key)
+		}
+	}
+	HealthChecks.Lock.Unlock() // RW
+}
+
+// slowStartWeights returns the share of answers (0.0 to just under 1.0) that each
+// currently ramping address has earned.  Addresses not ramping are not listed.
+func slowStartWeights() map[string]float64 {
+	type ramp struct {
+		target string
+		addrs  []string // nil: look up the target's addresses
+		weight float64
+	}
+	ramps := []ramp{}
+	now := time.Now()
+
+	HealthChecks.Lock.RLock() // RO
+	for key := range HealthChecks.Ramping {
+		info, ok := HealthChecks.Info[key]
+		if !ok || len(info.Recovered) == 0 {
+			continue
+		}
+		window := slowStartWindow(key.Service)
+		for addr, since := range info.Recovered {
+			elapsed := now.Sub(since)
+			if window <= 0 || elapsed >= window {
+				continue // Done ramping
+			}
+			r := ramp{target: key.Target, weight: float64(elapsed) / float64(window)}
+			if addr != "" {
+				r.addrs = []string{addr}
+			} else if info.Addrs != nil {
+				for a := range info.Addrs {
+					r.addrs = append(r.addrs, a)
+				}
+			}
+			ramps = append(ramps, r)
+		}
+	}
+	HealthChecks.Lock.RUnlock() // RO
+
+	if len(ramps) == 0 {
+		return nil
+	}
+	weights := make(map[string]float64)
+	for _, r := range ramps {
+		if r.addrs == nil {
+			r.addrs = LookupAddresses(r.target) // Outside the lock; this may need the zone data
+		}
+		for _, addr := range r.addrs {
+			if w, ok := weights[addr]; !ok || r.weight < w {
+				weights[addr] = r.weight // The slowest ramp wins
+			}
+		}
+	}
+	return weights
+}
+
+// rrAddress returns the address in an A or AAAA record, or "".
+func rrAddress(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	}
+	return ""
+}
+
+// slowStartVariants returns the answer sets to rotate through.  Normally
+// that is just the one; while addresses are ramping up, it is SlowStartSteps
+// sets, with each ramping address left out of the ones it has not yet earned.
+func slowStartVariants(answers []dns.RR) [][]dns.RR {
+	weights := slowStartWeights()
+	ramping := false
+	for _, rr := range answers {
+		if _, ok := weights[rrAddress(rr)]; ok {
+			ramping = true
+			break
+		}
+	}
+	if !ramping {
+		return [][]dns.RR{answers}
+	}
+
+	variants := make([][]dns.RR, 0, SlowStartSteps)
+	for k := 0; k < SlowStartSteps; k++ {
+		variant := []dns.RR{}
+		for _, rr := range answers {
+			if w, ok := weights[rrAddress(rr)]; ok && k >= int(w*float64(SlowStartSteps)) {
+				continue // Not yet earned a place in this one
+			}
+			variant = append(variant, rr)
+		}
+		if len(variant) == 0 {
+			variant = answers // Everything is ramping; better than nothing
+		}
+		variants = append(variants, variant)
+	}
+	return variants
+}
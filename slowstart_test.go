@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// setRecovered makes a check look like it came back up at a given time.
+func setRecovered(service string, target string, since time.Time) {
+	key := ServiceTargetKey{service, target}
+	HealthChecks.Lock.Lock()
+	HealthChecks.Info[key].Recovered = map[string]time.Time{"": since}
+	HealthChecks.Ramping[key] = true
+	HealthChecks.Lock.Unlock()
+}
+
+func TestSlowStartVariants(t *testing.T) {
+	initGlobal("t/etc")
+	AddCheck("check_unit_slow", "one.example.com", 3600)
+	waitForPoll("check_unit_slow", "one.example.com")
+
+	answers := []dns.RR{}
+	for _, s := range []string{"one.example.com. 300 IN A 192.0.2.1", "two.example.com. 300 IN A 192.0.2.2"} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("dns.NewRR(%s): %v", s, err)
+		}
+		answers = append(answers, rr)
+	}
+
+	// Not ramping: just the one variant.
+	if variants := slowStartVariants(answers); len(variants) != 1 || len(variants[0]) != 2 {
+		t.Errorf("slowStartVariants() with nothing ramping, found %v", variants)
+	}
+
+	var tests = []struct {
+		ago  time.Duration
+		with int // Variants including 192.0.2.1
+	}{
+		{0, 0},
+		{35 * time.Second, 3},
+		{99 * time.Second, 9},
+		{100 * time.Second, SlowStartSteps}, // Done ramping
+	}
+	for _, tt := range tests {
+		setRecovered("check_unit_slow", "one.example.com", time.Now().Add(-tt.ago))
+
+		with := 0
+		variants := slowStartVariants(answers)
+		for _, v := range variants {
+			for _, rr := range v {
+				if rrAddress(rr) == "192.0.2.1" {
+					with++
+				}
+			}
+		}
+		if len(variants) == 1 {
+			with = with * SlowStartSteps // One variant stands for all of them
+		}
+		if with != tt.with {
+			t.Errorf("slowStartVariants() %v after recovery, wanted 192.0.2.1 in %v variants, found %v", tt.ago, tt.with, with)
+		}
+	}
+}
+
+func TestSlowStartCache(t *testing.T) {
+	initGlobal("t/etc")
+	AddCheck("check_unit_slow", "one.example.com", 3600)
+	waitForPoll("check_unit_slow", "one.example.com")
+	setRecovered("check_unit_slow", "one.example.com", time.Now().Add(-30*time.Second)) // 30% of the way
+	defer setRecovered("check_unit_slow", "one.example.com", time.Time{})
+	ClearCaches("unit testing TestSlowStartCache")
+
+	// Cached answers hand out 192.0.2.1 in proportion to its weight; not more,
+	// just because the variants with it have more rotations.
+	askGSLB(t, dnssecQuery("drain.example.com.", dns.TypeA, false))
+	var QI QueryInfo
+	var group []MsgCacheRecord
+	CacheMsgs.Lock.RLock()
+	for k, v := range CacheMsgs.Cache {
+		if k.qname == "drain.example.com." && k.qtype == "A" {
+			QI, group = k, v.val
+		}
+	}
+	CacheMsgs.Lock.RUnlock()
+	with := 0
+	for _, record := range group {
+		m := new(dns.Msg)
+		if err := m.Unpack(record.msg); err != nil {
+			t.Fatalf("cached answer: %v", err)
+		}
+		for _, rr := range m.Answer {
+			if a, ok := rr.(*dns.A); ok && a.A.Equal(net.ParseIP("192.0.2.1")) {
+				with++
+			}
+		}
+	}
+	if len(group) == 0 || float64(with)/float64(len(group)) != 0.3 {
+		t.Errorf("192.0.2.1 in %v of %v cached answers, wanted 30%%", with, len(group))
+	}
+
+	// The next step of the ramp drops just the answers built from variants.
+	slowStartForget()
+	if _, ok := CacheMsgs.Get(QI); ok {
+		t.Errorf("cached answer for %v survived the next ramp step", QI.qname)
+	}
+}
@@ -18,6 +18,8 @@ var statsResponse = newStat("response")
 var statsMaxMindASN = newStat("maxmind_asn")
 var statsMaxMindCountry = newStat("maxmind_country")
 var statsCache = newStat("cache")
+var statsNotify = newStat("notify")
+var statsEvents = newStat("events")
 
 func (b *statsBundleType) Increment(s string) {
 	b.counters.Add(s, 1)
@@ -101,6 +101,13 @@ func (c *CacheContainer_LookupBEKey_strings) Set(k LookupBEKey, v []string) {
 	}
 }
 
+// Delete (k LookupBEKey) removes one entry from the cache, if it is there.
+func (c *CacheContainer_LookupBEKey_strings) Delete(k LookupBEKey) {
+	c.Lock.Lock() // Read+Write Lock
+	delete(c.Cache, k)
+	c.Lock.Unlock()
+}
+
 func (c *CacheContainer_LookupBEKey_strings) CheckConfig() {
 	if GlobalConfigAvailable() {
 		config := GlobalConfig()
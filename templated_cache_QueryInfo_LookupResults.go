@@ -101,6 +101,13 @@ func (c *CacheContainer_QueryInfo_LookupResults) Set(k QueryInfo, v LookupResult
 	}
 }
 
+// Delete (k QueryInfo) removes one entry from the cache, if it is there.
+func (c *CacheContainer_QueryInfo_LookupResults) Delete(k QueryInfo) {
+	c.Lock.Lock() // Read+Write Lock
+	delete(c.Cache, k)
+	c.Lock.Unlock()
+}
+
 func (c *CacheContainer_QueryInfo_LookupResults) CheckConfig() {
 	if GlobalConfigAvailable() {
 		config := GlobalConfig()
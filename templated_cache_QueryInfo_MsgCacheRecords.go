@@ -101,6 +101,13 @@ func (c *CacheContainer_QueryInfo_MsgCacheRecords) Set(k QueryInfo, v []MsgCache
 	}
 }
 
+// Delete (k QueryInfo) removes one entry from the cache, if it is there.
+func (c *CacheContainer_QueryInfo_MsgCacheRecords) Delete(k QueryInfo) {
+	c.Lock.Lock() // Read+Write Lock
+	delete(c.Cache, k)
+	c.Lock.Unlock()
+}
+
 func (c *CacheContainer_QueryInfo_MsgCacheRecords) CheckConfig() {
 	if GlobalConfigAvailable() {
 		config := GlobalConfig()
@@ -101,6 +101,13 @@ func (c *CacheContainer_string_string) Set(k string, v string) {
 	}
 }
 
+// Delete (k string) removes one entry from the cache, if it is there.
+func (c *CacheContainer_string_string) Delete(k string) {
+	c.Lock.Lock() // Read+Write Lock
+	delete(c.Cache, k)
+	c.Lock.Unlock()
+}
+
 func (c *CacheContainer_string_string) CheckConfig() {
 	if GlobalConfigAvailable() {
 		config := GlobalConfig()
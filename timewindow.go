@@ -0,0 +1,248 @@
+package main
+
+/*
+Time windows.
+
+Any line in zone.conf can be limited to certain times of the week, by
+adding "during=" or "except=" qualifiers (UTC):
+
+  comcast-pa.test-ipv6.com: HC check_mirror comcast-pa.test-ipv6.com except=Sun/02:00-04:00
+
+  [comcast]
+  www.example.com: EXPAND peak.example.com during=Mon-Fri/17:00-22:00
+  www.example.com: EXPAND normal.example.com except=Mon-Fri/17:00-22:00
+
+A window is [DAYS/]HH:MM-HH:MM, where DAYS is one day (Sun) or a range
+(Mon-Fri); without DAYS, it is every day.  A window may wrap past
+midnight (Sat/22:00-02:00 ends Sunday morning).  "24:00" is the end of
+the day.  With several "during=", any one will do; any one "except="
+is enough to leave the line out.
+
+Qualifiers are the last words of a line.  TXT and SPF lines are free
+text, and never have qualifiers ("v=spf1 ... except=x" is just data).
+
+Caches are cleared at every window boundary, so answers change on time.
+00:00-24:00 every day has no boundaries; it is always on.
+*/
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a weekly recurring window of time, in UTC.
+type TimeWindow struct {
+	Days  [7]bool // Indexed by time.Weekday; the day the window starts on
+	Start int     // Minutes past midnight
+	End   int     // Minutes past midnight; if not after Start, the window wraps into the next day
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseClock turns "HH:MM" into minutes past midnight.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("bad time %q, wanted HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseTimeWindow parses [DAYS/]HH:MM-HH:MM.
+func parseTimeWindow(s string) (w TimeWindow, err error) {
+	clock := s
+	if slash := strings.IndexByte(s, '/'); slash >= 0 {
+		days := toLower(s[:slash])
+		clock = s[slash+1:]
+		first, last := days, days
+		if dash := strings.IndexByte(days, '-'); dash >= 0 {
+			first, last = days[:dash], days[dash+1:]
+		}
+		from, ok1 := weekdayNames[first]
+		to, ok2 := weekdayNames[last]
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("bad days %q in %q", days, s)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == to {
+				break
+			}
+		}
+	} else {
+		for d := range w.Days {
+			w.Days[d] = true
+		}
+	}
+	dash := strings.IndexByte(clock, '-')
+	if dash < 0 {
+		return w, fmt.Errorf("bad window %q, wanted [DAYS/]HH:MM-HH:MM", s)
+	}
+	if w.Start, err = parseClock(clock[:dash]); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(clock[dash+1:]); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// Contains returns true if t falls inside the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	d := t.Weekday()
+	if w.Start < w.End {
+		return w.Days[d] && m >= w.Start && m < w.End
+	}
+	yesterday := (d + 6) % 7
+	return (w.Days[d] && m >= w.Start) || (w.Days[yesterday] && m < w.End)
+}
+
+// NextBoundary returns the next time after t that the window opens or closes.
+// Midnights between back to back full days are not boundaries; a window
+// that is always open (every day, 00:00-24:00) has none, and returns zero.
+func (w TimeWindow) NextBoundary(t time.Time) time.Time {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	end := w.End
+	if w.End <= w.Start {
+		end += 24 * 60 // Closes the next day
+	}
+	var next time.Time
+	for i := -1; i <= 7; i++ {
+		day := midnight.AddDate(0, 0, i)
+		if !w.Days[day.Weekday()] {
+			continue
+		}
+		for _, m := range []int{w.Start, end} {
+			b := day.Add(time.Duration(m) * time.Minute)
+			if w.Contains(b.Add(-time.Minute)) == w.Contains(b) {
+				continue // Open (or closed) on both sides; nothing changes here
+			}
+			if b.After(t) && (next.IsZero() || b.Before(next)) {
+				next = b
+			}
+		}
+	}
+	return next
+}
+
+// windowFreeText are the record types whose data is free text, where
+// "during=" and "except=" are just more data.
+var windowFreeText = map[string]bool{"TXT": true, "SPF": true}
+
+// isTimeQualifier returns true for a during= or except= word.
+func isTimeQualifier(word string) bool {
+	return strings.HasPrefix(word, "during=") || strings.HasPrefix(word, "except=")
+}
+
+// splitQualifiers splits the words of a zone line into its data, and the
+// time qualifiers at the end of it (if the line's type can have any).
+func splitQualifiers(words []string) (data []string, quals []string) {
+	if len(words) == 0 || windowFreeText[toUpper(words[0])] {
+		return words, nil
+	}
+	n := len(words)
+	for n > 1 && isTimeQualifier(words[n-1]) {
+		n--
+	}
+	return words[:n], words[n:]
+}
+
+// timeQualifiers strips any during=/except= qualifiers from the words of a
+// zone line, and returns whether the line applies at time t.
+// Lines with bad qualifiers apply, with an error to say why.
+func timeQualifiers(words []string, t time.Time) (stripped []string, active bool, err error) {
+	stripped, quals := splitQualifiers(words)
+	during, inside := false, false
+	active = true
+	for _, word := range quals {
+		spec, except := word[len("during="):], false
+		if strings.HasPrefix(word, "except=") {
+			spec, except = word[len("except="):], true
+		}
+		w, e := parseTimeWindow(spec)
+		if e != nil {
+			err = e
+			continue
+		}
+		if except && w.Contains(t) {
+			active = false
+		}
+		if !except {
+			during = true
+			inside = inside || w.Contains(t)
+		}
+	}
+	if during && !inside {
+		active = false
+	}
+	if err != nil {
+		active = true
+	}
+	return stripped, active, err
+}
+
+// hasTimeQualifiers returns true if a zone line (and its words) ends with
+// time qualifiers.
+func hasTimeQualifiers(line string, words []string) bool {
+	if !strings.Contains(line, "during=") && !strings.Contains(line, "except=") {
+		return false // The quick answer, for most lines
+	}
+	_, quals := splitQualifiers(words)
+	return len(quals) > 0
+}
+
+// activeWords splits a zone line into words, without any time qualifiers,
+// and says whether the line applies at time t.
+func activeWords(line string, t time.Time) (words []string, active bool) {
+	words = QuotedStringToWords(line)
+	if !hasTimeQualifiers(line, words) {
+		return words, true
+	}
+	words, active, _ = timeQualifiers(words, t)
+	return words, active && len(words) > 0
+}
+
+// nextWindowBoundary scans the zone data for time windows, and returns the
+// next time (after t) that any of them opens or closes.  Zero if none.
+func nextWindowBoundary(z *Config, t time.Time) (next time.Time) {
+	for _, val := range z.Data {
+		for _, s := range val.Values {
+			if !strings.Contains(s, "during=") && !strings.Contains(s, "except=") {
+				continue
+			}
+			_, quals := splitQualifiers(QuotedStringToWords(s))
+			for _, word := range quals {
+				w, err := parseTimeWindow(word[strings.IndexByte(word, '=')+1:])
+				if err != nil {
+					continue
+				}
+				if b := w.NextBoundary(t); !b.IsZero() && (next.IsZero() || b.Before(next)) {
+					next = b
+				}
+			}
+		}
+	}
+	return next
+}
+
+// taskTimeWindows clears the caches whenever a time window opens or closes.
+// It wakes at least once a minute, to notice zone.conf changes.
+func taskTimeWindows() {
+	for {
+		now := time.Now()
+		next := nextWindowBoundary(GlobalZoneData(), now)
+		if next.IsZero() || next.Sub(now) > time.Minute {
+			time.Sleep(time.Minute)
+			continue
+		}
+		time.Sleep(next.Sub(now))
+		ClearCaches("time window boundary " + next.Format("Mon 15:04"))
+	}
+}
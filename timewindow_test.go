@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var tableTimeWindow = []struct {
+	spec     string
+	at       string // RFC3339, UTC
+	contains bool
+	next     string
+}{
+	{"Sun/02:00-04:00", "2024-06-02T03:00:00Z", true, "2024-06-02T04:00:00Z"}, // A Sunday
+	{"Sun/02:00-04:00", "2024-06-02T04:00:00Z", false, "2024-06-09T02:00:00Z"},
+	{"Sun/02:00-04:00", "2024-06-03T03:00:00Z", false, "2024-06-09T02:00:00Z"},
+	{"Mon-Fri/17:00-22:00", "2024-06-07T18:30:00Z", true, "2024-06-07T22:00:00Z"}, // A Friday
+	{"Mon-Fri/17:00-22:00", "2024-06-08T18:30:00Z", false, "2024-06-10T17:00:00Z"},
+	{"Sat/22:00-02:00", "2024-06-09T01:00:00Z", true, "2024-06-09T02:00:00Z"}, // Wrapped into Sunday
+	{"Sat/22:00-02:00", "2024-06-10T01:00:00Z", false, "2024-06-15T22:00:00Z"},
+	{"00:00-24:00", "2024-06-10T12:00:00Z", true, "0001-01-01T00:00:00Z"}, // Always on: no boundaries
+	{"Mon-Fri/00:00-24:00", "2024-06-11T12:00:00Z", true, "2024-06-15T00:00:00Z"},
+	{"Fri-Mon/12:00-13:00", "2024-06-09T12:30:00Z", true, "2024-06-09T13:00:00Z"}, // Sunday, in a wrapped day range
+}
+
+func TestTimeWindow(t *testing.T) {
+	for _, tt := range tableTimeWindow {
+		w, err := parseTimeWindow(tt.spec)
+		if err != nil {
+			t.Errorf("parseTimeWindow(%v): %v", tt.spec, err)
+			continue
+		}
+		at, _ := time.Parse(time.RFC3339, tt.at)
+		if found := w.Contains(at); found != tt.contains {
+			t.Errorf("%v Contains(%v) wanted %v found %v", tt.spec, tt.at, tt.contains, found)
+		}
+		if found := w.NextBoundary(at).Format(time.RFC3339); found != tt.next {
+			t.Errorf("%v NextBoundary(%v) wanted %v found %v", tt.spec, tt.at, tt.next, found)
+		}
+	}
+	for _, bad := range []string{"Sun", "Funday/01:00-02:00", "25:00-26:00", "01:00"} {
+		if _, err := parseTimeWindow(bad); err == nil {
+			t.Errorf("parseTimeWindow(%v) should have failed", bad)
+		}
+	}
+}
+
+func TestTimeQualifiers(t *testing.T) {
+	initGlobal("t/etc")
+	ClearCaches("unit testing TestTimeQualifiers")
+	zoneRef := GlobalZoneData()
+	notrace := NewLookupTraceOff()
+
+	at, _ := time.Parse(time.RFC3339, "2024-06-02T03:00:00Z")
+	words, active, err := timeQualifiers([]string{"HC", "check_true", "one.example.com", "except=Sun/02:00-04:00"}, at)
+	if active || err != nil || fmt.Sprintf("%v", words) != "[HC check_true one.example.com]" {
+		t.Errorf("timeQualifiers(except=) found %v %v %v", words, active, err)
+	}
+	words, active, err = timeQualifiers([]string{"A", "192.0.2.1", "during=Mon/00:00-01:00", "during=Sun/02:00-04:00"}, at)
+	if !active || err != nil || fmt.Sprintf("%v", words) != "[A 192.0.2.1]" {
+		t.Errorf("timeQualifiers(during=) found %v %v %v", words, active, err)
+	}
+
+	// Only trailing words are qualifiers, and never in free text.
+	var split = []struct {
+		line  string
+		data  string
+		quals string
+	}{
+		{"A 192.0.2.1 except=Sun/02:00-04:00", "[A 192.0.2.1]", "[except=Sun/02:00-04:00]"},
+		{"A 192.0.2.1 during=Mon/00:00-01:00 except=Sun/02:00-04:00", "[A 192.0.2.1]", "[during=Mon/00:00-01:00 except=Sun/02:00-04:00]"},
+		{"HC check_true during=x one.example.com", "[HC check_true during=x one.example.com]", "[]"},
+		{"TXT v=spf1 except=Sun/02:00-04:00", "[TXT v=spf1 except=Sun/02:00-04:00]", "[]"},
+		{"spf during=Mon/00:00-01:00", "[spf during=Mon/00:00-01:00]", "[]"},
+	}
+	for _, tt := range split {
+		data, quals := splitQualifiers(QuotedStringToWords(tt.line))
+		if fmt.Sprintf("%v", data) != tt.data || fmt.Sprintf("%v", quals) != tt.quals {
+			t.Errorf("splitQualifiers(%s) found %v %v, wanted %s %s", tt.line, data, quals, tt.data, tt.quals)
+		}
+	}
+	found := fmt.Sprintf("%v", LookupBackEnd("txtwindow.example.com", "default", false, zoneRef, 0, notrace))
+	if found != "[TXT during=Mon/00:00-00:01]" {
+		t.Errorf("LookupBackEnd(txtwindow.example.com) found %v", found)
+	}
+
+	found = fmt.Sprintf("%v", LookupBackEnd("always.example.com", "default", false, zoneRef, 0, notrace))
+	if found != "[A 192.0.2.1]" {
+		t.Errorf("LookupBackEnd(always.example.com) found %v", found)
+	}
+	if next := nextWindowBoundary(zoneRef, at); next.Format(time.RFC3339) != "2024-06-03T00:00:00Z" {
+		t.Errorf("nextWindowBoundary() found %v", next)
+	}
+	// Out of their window, lines don't count towards the health of a name.
+	waitForPoll("check_true", "one.example.com")
+	if healthyHC([]string{"HC check_true one.example.com except=00:00-24:00"}) {
+		t.Errorf("healthyHC() counted a line outside its time window")
+	}
+	if !healthyHC([]string{"HC check_true one.example.com during=00:00-24:00"}) {
+		t.Errorf("healthyHC() did not count a line inside its time window")
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+/*
+Outbound zone transfers (AXFR and IXFR), so plain secondaries (BIND,
+NSD, ...) can keep a copy of our answers as a backstop.
+
+[xfr]
+view: default                              # whose answers the secondaries get (default "default")
+history: 20                                # changes kept per zone, for IXFR (default 20)
+notify: [192.0.2.53, 192.0.2.54:5353]      # told (DNS NOTIFY) whenever a zone changes
+example.com: [192.0.2.53, 2001:db8::/32]   # who may transfer example.com (IPs or CIDRs)
+
+Every other name in [xfr] is a zone, and the list of secondaries that
+may transfer it.  Transfers are over TCP only; over UDP, an IXFR gets
+just the current SOA (so the secondary asks again over TCP) and an AXFR
+is refused.
+
+A zone is "computed" the same way as any answer: every name in the zone
+data of the view (and [default]), looked up with LookupFrontEnd, health
+checks and all.  A DELEGATE gives its NS records and the glue (the
+addresses of name servers within the zone); names below it are left
+out, as they are the child zone's.  After every cache clear (config reloads, health
+changes, ...) the zones are computed again; if anything changed, the
+zone gets a new serial (the time, or one more than the last), the
+change is kept for IXFR, and the notify list is told.  SOA answers to
+ordinary queries carry the same serial, so secondaries polling the SOA
+see changes too (they never wait for a zone to be computed: until the
+first snapshot, they carry the serial in zone.conf).  An IXFR from a serial we no longer have the changes
+for gets the whole zone instead.
+
+DNSSEC signed zones are not transferred (a secondary would serve them
+unsigned).
+*/
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// XfrDefaultHistory is how many changes are kept per zone, for IXFR.
+var XfrDefaultHistory = 20
+
+// XfrChunk is how many records go in each message of a transfer.
+var XfrChunk = 200
+
+// xfrReserved are the names in [xfr] that are settings, not zones.
+var xfrReserved = map[string]bool{"view": true, "history": true, "notify": true}
+
+var statsXfr = newStat("xfr")
+
+// ZoneSnapshot is one computed copy of a zone.
+type ZoneSnapshot struct {
+	SOA     *dns.SOA
+	Records []dns.RR // Sorted; without the SOA
+}
+
+// ZoneDiff is the change from one snapshot to the next.
+type ZoneDiff struct {
+	From    *dns.SOA
+	To      *dns.SOA
+	Deleted []dns.RR
+	Added   []dns.RR
+}
+
+// xfrZone is the current snapshot of a zone, and its recent changes.
+type xfrZone struct {
+	sync.Mutex
+	current *ZoneSnapshot
+	history []ZoneDiff // Oldest first
+}
+
+var xfrZones = make(map[string]*xfrZone)
+var xfrZonesLock sync.Mutex
+
+// xfrZoneFor finds (or starts) the transfer state of a zone.
+func xfrZoneFor(zone string) *xfrZone {
+	xfrZonesLock.Lock()
+	defer xfrZonesLock.Unlock()
+	x, ok := xfrZones[zone]
+	if !ok {
+		x = &xfrZone{}
+		xfrZones[zone] = x
+	}
+	return x
+}
+
+// xfrView is the view whose answers are transferred.
+func xfrView() string {
+	if s, ok := GlobalConfig().GetSectionNameValueString("xfr", "view"); ok && s != "" {
+		return toLower(s)
+	}
+	return DEFAULT
+}
+
+// xfrHistory is how many changes to keep per zone.
+func xfrHistory() int {
+	if i, ok := GlobalConfig().GetSectionNameValueInt("xfr", "history"); ok && i >= 0 {
+		return i
+	}
+	return XfrDefaultHistory
+}
+
+// xfrZoneList lists the zones set up for transfer.
+func xfrZoneList() []string {
+	zones := []string{}
+	for key := range GlobalConfig().Data {
+		if zone := strings.TrimSuffix(toLower(key.Name), "."); key.Section == "xfr" && xfrConfigured(zone) {
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// xfrConfigured returns true if a zone is set up for transfer (and not signed).
+func xfrConfigured(zone string) bool {
+	if xfrReserved[zone] {
+		return false
+	}
+	if _, signed := GlobalKeys()[zone]; signed {
+		return false
+	}
+	_, ok := GlobalConfig().GetSectionNameValueStrings("xfr", zone)
+	return ok
+}
+
+// xfrAllowed returns true if a secondary may transfer a zone.
+func xfrAllowed(zone string, remote net.Addr) bool {
+	if !xfrConfigured(zone) {
+		return false
+	}
+	list, _ := GlobalConfig().GetSectionNameValueStrings("xfr", zone)
+	return addrAllowed(remoteIP(remote), list)
+}
+
+// zoneNames lists every name in the zone data of a view (and [default]) that is in a zone.
+func zoneNames(zone string, view string) []string {
+	seen := make(map[string]bool)
+	for key := range GlobalZoneData().Data {
+		if key.Section != view && key.Section != DEFAULT {
+			continue
+		}
+		name := strings.TrimSuffix(toLower(key.Name), ".")
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			seen[name] = true
+		}
+	}
+	names := []string{}
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// xfrChildZones lists the zones in [xfr] below a zone (signed or not).
+func xfrChildZones(zone string) []string {
+	children := []string{}
+	for key := range GlobalConfig().Data {
+		name := strings.TrimSuffix(toLower(key.Name), ".")
+		if key.Section == "xfr" && !xfrReserved[name] && strings.HasSuffix(name, "."+zone) {
+			children = append(children, name)
+		}
+	}
+	return children
+}
+
+// computeZone looks up every name of a zone, as a view would see it.
+// Names below a delegation are not ours (only their glue is); nor is
+// another zone in [xfr], delegated or not.
+func computeZone(zone string, view string) (*ZoneSnapshot, error) {
+	snap := &ZoneSnapshot{}
+	names := zoneNames(zone, view)
+	results := make(map[string]LookupResults)
+	children := xfrChildZones(zone)
+	cuts := []string{}
+	for _, name := range names {
+		r := LookupFrontEndNoCache(name, view, "ANY", 0, NOTRACE)
+		results[name] = r
+		if !r.Aa && name != zone {
+			cuts = append(cuts, name)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if occluded(name, cuts) || inZones(name, children) {
+			continue
+		}
+		r := results[name]
+		lines := r.Ans
+		if !r.Aa {
+			lines = append(append([]string{}, r.Auth...), r.Add...) // A delegation: the NS records and glue are ours to hand on
+		}
+		for _, line := range lines {
+			rr, err := dns.NewRR(line)
+			if err != nil || rr == nil {
+				continue
+			}
+			owner := toLower(rr.Header().Name)
+			if !dns.IsSubDomain(zone+".", owner) {
+				continue
+			}
+			rr.Header().Name = owner
+			if soa, ok := rr.(*dns.SOA); ok {
+				if owner == zone+"." {
+					snap.SOA = soa
+				}
+				continue
+			}
+			if text := rr.String(); !seen[text] {
+				seen[text] = true
+				snap.Records = append(snap.Records, rr)
+			}
+		}
+	}
+	if snap.SOA == nil {
+		return nil, fmt.Errorf("%s has no SOA in view %s", zone, view)
+	}
+	sort.Slice(snap.Records, func(i, j int) bool {
+		a, b := snap.Records[i].Header(), snap.Records[j].Header()
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Rrtype != b.Rrtype {
+			return a.Rrtype < b.Rrtype
+		}
+		return snap.Records[i].String() < snap.Records[j].String()
+	})
+	return snap, nil
+}
+
+// occluded returns true if a name is below one of the zone cuts.
+func occluded(name string, cuts []string) bool {
+	for _, cut := range cuts {
+		if strings.HasSuffix(name, "."+cut) {
+			return true
+		}
+	}
+	return false
+}
+
+// inZones returns true if a name is in (at or below the apex of) one of the zones.
+func inZones(name string, zones []string) bool {
+	for _, zone := range zones {
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// soaText is an SOA without its serial, to see if anything else changed.
+func soaText(soa *dns.SOA) string {
+	c := dns.Copy(soa).(*dns.SOA)
+	c.Serial = 0
+	return c.String()
+}
+
+// diffSnapshots works out what changed between two snapshots.
+func diffSnapshots(old *ZoneSnapshot, snap *ZoneSnapshot) ZoneDiff {
+	d := ZoneDiff{From: old.SOA, To: snap.SOA}
+	before := make(map[string]bool)
+	for _, rr := range old.Records {
+		before[rr.String()] = true
+	}
+	after := make(map[string]bool)
+	for _, rr := range snap.Records {
+		after[rr.String()] = true
+		if !before[rr.String()] {
+			d.Added = append(d.Added, rr)
+		}
+	}
+	for _, rr := range old.Records {
+		if !after[rr.String()] {
+			d.Deleted = append(d.Deleted, rr)
+		}
+	}
+	return d
+}
+
+// xfrRefresh computes a zone again, as of now.  If it changed since the
+// last time, it gets a new serial and the change is kept for IXFR.
+// Returns true if there was a last time, and the zone changed since.
+func xfrRefresh(zone string, now time.Time) (changed bool, err error) {
+	snap, err := computeZone(zone, xfrView())
+	if err != nil {
+		return false, err
+	}
+	x := xfrZoneFor(zone)
+	x.Lock()
+	defer x.Unlock()
+
+	old := x.current
+	if old != nil && soaText(old.SOA) == soaText(snap.SOA) {
+		d := diffSnapshots(old, snap)
+		if len(d.Added) == 0 && len(d.Deleted) == 0 {
+			return false, nil
+		}
+	}
+
+	serial := uint32(now.Unix())
+	if snap.SOA.Serial > serial {
+		serial = snap.SOA.Serial
+	}
+	if old != nil && int32(serial-old.SOA.Serial) <= 0 { // Serial number arithmetic (RFC 1982)
+		serial = old.SOA.Serial + 1
+	}
+	snap.SOA.Serial = serial
+	x.current = snap
+	if old == nil {
+		return false, nil
+	}
+
+	x.history = append(x.history, diffSnapshots(old, snap))
+	if keep := xfrHistory(); len(x.history) > keep {
+		x.history = x.history[len(x.history)-keep:]
+	}
+	return true, nil
+}
+
+// xfrSnapshot returns the current snapshot of a zone, computing it if there is none yet.
+func xfrSnapshot(zone string) *ZoneSnapshot {
+	x := xfrZoneFor(zone)
+	x.Lock()
+	snap := x.current
+	x.Unlock()
+	if snap != nil {
+		return snap
+	}
+	if _, err := xfrRefresh(zone, time.Now()); err != nil {
+		log.Printf("xfr: %v\n", err)
+		return nil
+	}
+	x.Lock()
+	defer x.Unlock()
+	return x.current
+}
+
+// xfrCurrent returns the current snapshot of a zone, if there is one yet.
+// It never computes the zone; with no snapshot, it asks taskTransfers for one.
+func xfrCurrent(zone string) *ZoneSnapshot {
+	x := xfrZoneFor(zone)
+	x.Lock()
+	defer x.Unlock()
+	if x.current == nil {
+		triggerTransfers()
+	}
+	return x.current
+}
+
+// xfrSerials gives the SOA records of transferred zones the serial of their snapshot.
+// This is on the query path, so it only uses snapshots already made.
+func xfrSerials(m *dns.Msg) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				continue
+			}
+			zone := strings.TrimSuffix(toLower(soa.Hdr.Name), ".")
+			if !xfrConfigured(zone) {
+				continue
+			}
+			if snap := xfrCurrent(zone); snap != nil {
+				soa.Serial = snap.SOA.Serial
+			}
+		}
+	}
+}
+
+// axfrRecords is a whole zone, as an AXFR sends it: SOA, records, SOA.
+func axfrRecords(snap *ZoneSnapshot) []dns.RR {
+	rrs := []dns.RR{snap.SOA}
+	rrs = append(rrs, snap.Records...)
+	return append(rrs, snap.SOA)
+}
+
+// ixfrRecords is the changes since a serial, as an IXFR sends them.
+// Returns nil if we do not have every change since then.
+func ixfrRecords(zone string, serial uint32) []dns.RR {
+	x := xfrZoneFor(zone)
+	x.Lock()
+	defer x.Unlock()
+	if x.current == nil {
+		return nil
+	}
+	current := x.current.SOA
+	if serial == current.Serial {
+		return []dns.RR{current} // Up to date
+	}
+	for i, d := range x.history {
+		if d.From.Serial != serial {
+			continue
+		}
+		rrs := []dns.RR{current}
+		for _, change := range x.history[i:] {
+			rrs = append(rrs, change.From)
+			rrs = append(rrs, change.Deleted...)
+			rrs = append(rrs, change.To)
+			rrs = append(rrs, change.Added...)
+		}
+		return append(rrs, current)
+	}
+	return nil
+}
+
+// ixfrSerial finds the serial a secondary has, from the SOA in an IXFR query.
+func ixfrSerial(r *dns.Msg) (uint32, bool) {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+	return 0, false
+}
+
+// handleTransfer answers AXFR and IXFR queries.
+func handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	qtype := r.Question[0].Qtype
+	zone := strings.TrimSuffix(toLower(r.Question[0].Name), ".")
+	kind := toLower(qtypeToString(qtype))
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	refuse := func(why string) {
+		log.Printf("xfr: refused %s of %s to %s: %s\n", kind, zone, w.RemoteAddr(), why)
+		statsXfr.Increment("refused")
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+	}
+	if _, signed := GlobalKeys()[zone]; signed {
+		refuse("zone is signed")
+		return
+	}
+	if !xfrAllowed(zone, w.RemoteAddr()) {
+		refuse("not allowed")
+		return
+	}
+	snap := xfrSnapshot(zone)
+	if snap == nil {
+		refuse("no zone")
+		return
+	}
+
+	if _, tcp := w.RemoteAddr().(*net.TCPAddr); !tcp {
+		if qtype != dns.TypeIXFR {
+			refuse("not over TCP")
+			return
+		}
+		m.Authoritative = true
+		m.Answer = []dns.RR{snap.SOA} // Ask again over TCP
+		w.WriteMsg(m)
+		return
+	}
+
+	var rrs []dns.RR
+	if serial, ok := ixfrSerial(r); ok && qtype == dns.TypeIXFR {
+		rrs = ixfrRecords(zone, serial)
+	}
+	if rrs == nil {
+		rrs = axfrRecords(snap)
+	}
+	statsXfr.Increment(kind)
+	for len(rrs) > 0 {
+		n := XfrChunk
+		if n > len(rrs) {
+			n = len(rrs)
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Compress = true
+		m.Answer = rrs[:n]
+		if err := w.WriteMsg(m); err != nil {
+			log.Printf("xfr: %s of %s to %s: %v\n", kind, zone, w.RemoteAddr(), err)
+			return
+		}
+		rrs = rrs[n:]
+	}
+}
+
+// xfrNotify tells the secondaries on the notify list that a zone changed.
+func xfrNotify(zone string) {
+	list, _ := GlobalConfig().GetSectionNameValueStrings("xfr", "notify")
+	for _, addr := range list {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		m := new(dns.Msg)
+		m.SetNotify(zone + ".")
+		c := &dns.Client{Timeout: time.Duration(2) * time.Second}
+		if _, _, err := c.Exchange(m, addr); err != nil {
+			statsXfr.Increment("notify-error")
+			log.Printf("xfr: notify %s of %s: %v\n", addr, zone, err)
+			continue
+		}
+		statsXfr.Increment("notify")
+	}
+}
+
+// xfrTrigger asks taskTransfers for another look; one pending request is enough.
+var xfrTrigger = make(chan bool, 1)
+
+// triggerTransfers asks for the transferred zones to be computed again, soon.
+func triggerTransfers() {
+	select {
+	case xfrTrigger <- true:
+	default:
+	}
+}
+
+// taskTransfers computes the transferred zones again, after every cache clear.
+func taskTransfers() {
+	for range xfrTrigger {
+		changed := []string{}
+		first := false // A zone's first snapshot changes the serial of its SOA answers too
+		for _, zone := range xfrZoneList() {
+			x := xfrZoneFor(zone)
+			x.Lock()
+			first = first || x.current == nil
+			x.Unlock()
+			ok, err := xfrRefresh(zone, time.Now())
+			if err != nil {
+				log.Printf("xfr: %v\n", err)
+			}
+			if ok {
+				changed = append(changed, zone)
+			}
+		}
+		if len(changed) > 0 || first {
+			CacheMsgs.ClearCache() // Cached SOA answers have the old serials
+		}
+		for _, zone := range changed {
+			go xfrNotify(zone)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transfer asks for a zone transfer, and returns every record sent.
+func transfer(t *testing.T, remote string, tcp bool, zone string, qtype uint16, serial uint32) (rrs []dns.RR, rcode int) {
+	w := &fakeDNSWriter{tcp: tcp, remote: &net.UDPAddr{IP: net.ParseIP(remote), Port: 5353}}
+	if tcp {
+		w.remote = &net.TCPAddr{IP: net.ParseIP(remote), Port: 5353}
+	}
+	r := new(dns.Msg)
+	r.SetQuestion(zone, qtype)
+	if qtype == dns.TypeIXFR {
+		r.SetIxfr(zone, serial, "ns1."+zone, "hostmaster."+zone)
+	}
+	handleGSLB(w, r)
+	for _, data := range w.all {
+		m := new(dns.Msg)
+		if err := m.Unpack(data); err != nil {
+			t.Fatalf("%s %s: bad reply: %v", dns.TypeToString[qtype], zone, err)
+		}
+		rcode = m.Rcode
+		rrs = append(rrs, m.Answer...)
+	}
+	return rrs, rcode
+}
+
+// soaSerial is the serial of an SOA record (0 if it is not one).
+func soaSerial(rr dns.RR) uint32 {
+	if soa, ok := rr.(*dns.SOA); ok {
+		return soa.Serial
+	}
+	return 0
+}
+
+// hasRR returns true if a record (in text) is in a list.
+func hasRR(rrs []dns.RR, text string) bool {
+	want, _ := dns.NewRR(text)
+	for _, rr := range rrs {
+		if rr.String() == want.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAXFR(t *testing.T) {
+	initGlobal("t/etc")
+
+	var tests = []struct {
+		remote string
+		tcp    bool
+		zone   string
+		qtype  uint16
+		rcode  int
+		count  int // Records sent; -1 for a whole zone
+	}{
+		{"192.0.2.200", true, "example.net.", dns.TypeAXFR, dns.RcodeSuccess, -1},
+		{"2001:db8::53", true, "example.net.", dns.TypeAXFR, dns.RcodeSuccess, -1},
+		{"198.51.100.1", true, "example.net.", dns.TypeAXFR, dns.RcodeRefused, 0}, // Not on the list
+		{"192.0.2.200", true, "example.org.", dns.TypeAXFR, dns.RcodeRefused, 0},  // Not set up
+		{"192.0.2.200", true, "example.com.", dns.TypeAXFR, dns.RcodeRefused, 0},  // Signed
+		{"192.0.2.200", false, "example.net.", dns.TypeAXFR, dns.RcodeRefused, 0}, // UDP
+		{"192.0.2.200", false, "example.net.", dns.TypeIXFR, dns.RcodeSuccess, 1}, // UDP: just the SOA
+	}
+	for _, tt := range tests {
+		rrs, rcode := transfer(t, tt.remote, tt.tcp, tt.zone, tt.qtype, 0)
+		if rcode != tt.rcode || (tt.count >= 0 && len(rrs) != tt.count) {
+			t.Errorf("%s %s from %s (tcp %v): rcode %v with %v records; wanted %v with %v", dns.TypeToString[tt.qtype], tt.zone, tt.remote, tt.tcp, rcodeToString(rcode), len(rrs), rcodeToString(tt.rcode), tt.count)
+			continue
+		}
+		if tt.count >= 0 {
+			continue
+		}
+
+		// A whole zone: SOA first and last, and everything between.
+		if len(rrs) < 2 || soaSerial(rrs[0]) == 0 || soaSerial(rrs[0]) != soaSerial(rrs[len(rrs)-1]) {
+			t.Fatalf("AXFR %s is not framed by the SOA: %v", tt.zone, rrs)
+		}
+		for _, want := range []string{
+			"example.net. 300 NS ns1.example.net.",
+			"www.example.net. 300 A 192.0.2.80",
+			"www.example.net. 300 AAAA 2001:db8::80",
+			"sub.example.net. 300 NS ns1.sub.example.net.", // The delegation
+			"ns1.sub.example.net. 300 A 192.0.2.53",        // and its glue
+		} {
+			if !hasRR(rrs, want) {
+				t.Errorf("AXFR %s lacks %s", tt.zone, want)
+			}
+		}
+		if hasRR(rrs, "www.sub.example.net. 300 A 192.0.2.81") {
+			t.Errorf("AXFR %s has www.sub.example.net, below the zone cut", tt.zone)
+		}
+		for _, rr := range rrs[1 : len(rrs)-1] {
+			if rr.Header().Rrtype == dns.TypeSOA || !dns.IsSubDomain("example.net.", rr.Header().Name) {
+				t.Errorf("AXFR %s has %v", tt.zone, rr)
+			}
+		}
+	}
+
+	// An ordinary SOA answer has the serial of the transferred zone.
+	m := askGSLB(t, dnssecQuery("example.net.", dns.TypeSOA, false))
+	if len(m.Answer) != 1 || soaSerial(m.Answer[0]) != xfrSnapshot("example.net").SOA.Serial {
+		t.Errorf("SOA of example.net is %v, wanted serial %v", m.Answer, xfrSnapshot("example.net").SOA.Serial)
+	}
+}
+
+func TestComputeZoneGlue(t *testing.T) {
+	initGlobal("t/etc")
+	// ns1.sub.example.net is below the cut, so it can only come in as glue.
+	if !occluded("ns1.sub.example.net", []string{"sub.example.net"}) {
+		t.Fatalf("ns1.sub.example.net not occluded by sub.example.net")
+	}
+	if occluded("sub.example.net", []string{"sub.example.net"}) || occluded("xsub.example.net", []string{"sub.example.net"}) {
+		t.Errorf("occluded() too eager")
+	}
+	snap, err := computeZone("example.net", DEFAULT)
+	if err != nil {
+		t.Fatalf("computeZone(example.net): %v", err)
+	}
+	var tests = []struct {
+		rr   string
+		want bool
+	}{
+		{"sub.example.net. 300 NS ns1.sub.example.net.", true},
+		{"ns1.sub.example.net. 300 A 192.0.2.53", true},  // Glue
+		{"www.sub.example.net. 300 A 192.0.2.81", false}, // The child zone's
+		{"www.example.net. 300 A 192.0.2.80", true},
+		{"child.example.net. 300 NS ns1.example.net.", false}, // Another zone in [xfr], with no DELEGATE
+		{"www.child.example.net. 300 A 192.0.2.82", false},
+	}
+	for _, tt := range tests {
+		if found := hasRR(snap.Records, tt.rr); found != tt.want {
+			t.Errorf("computeZone(example.net) has %s: %v, wanted %v", tt.rr, found, tt.want)
+		}
+	}
+	if snap, err := computeZone("child.example.net", DEFAULT); err != nil || !hasRR(snap.Records, "www.child.example.net. 300 A 192.0.2.82") {
+		t.Errorf("computeZone(child.example.net) lacks its own names: %v", err)
+	}
+}
+
+func TestIXFR(t *testing.T) {
+	initGlobal("t/etc")
+	zone := "example.net"
+	before := xfrSnapshot(zone).SOA.Serial
+
+	// Add a name, then take it away again; each is a change.
+	original := GlobalZoneData()
+	changed := NewConfig()
+	for key, val := range original.Data {
+		changed.Data[key] = val
+	}
+	changed.AddKeyValue(ConfigKey{DEFAULT, "new.example.net"}, "A 192.0.2.77")
+	for _, c := range []*Config{changed, original} {
+		SetGlobalZoneData(c)
+		CacheLookupBE.ClearCache()
+		CacheLookupFE.ClearCache()
+		if _, err := xfrRefresh(zone, time.Now()); err != nil {
+			t.Fatalf("xfrRefresh(%s): %v", zone, err)
+		}
+	}
+	after := xfrSnapshot(zone).SOA.Serial
+	if int32(after-before) < 2 {
+		t.Fatalf("serial went from %v to %v; wanted two changes", before, after)
+	}
+
+	// From the old serial: every change, in order.
+	rrs, rcode := transfer(t, "192.0.2.200", true, zone+".", dns.TypeIXFR, before)
+	if rcode != dns.RcodeSuccess || len(rrs) < 4 {
+		t.Fatalf("IXFR from %v: rcode %v, %v", before, rcodeToString(rcode), rrs)
+	}
+	if soaSerial(rrs[0]) != after || soaSerial(rrs[1]) != before || soaSerial(rrs[len(rrs)-1]) != after {
+		t.Errorf("IXFR from %v is not framed by SOAs %v..%v: %v", before, after, before, rrs)
+	}
+	added, deleted := false, false
+	inDeleted := true // Each change is: old SOA, deleted records, new SOA, added records
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			inDeleted = !inDeleted
+			continue
+		}
+		if strings.HasPrefix(rr.String(), "new.example.net.") {
+			if inDeleted {
+				deleted = true
+			} else {
+				added = true
+			}
+		}
+	}
+	if !added || !deleted {
+		t.Errorf("IXFR from %v: new.example.net added %v, deleted %v; wanted both: %v", before, added, deleted, rrs)
+	}
+
+	// Up to date: just the SOA.  Too old: the whole zone.
+	if rrs, _ := transfer(t, "192.0.2.200", true, zone+".", dns.TypeIXFR, after); len(rrs) != 1 || soaSerial(rrs[0]) != after {
+		t.Errorf("IXFR from the current serial %v: %v", after, rrs)
+	}
+	rrs, _ = transfer(t, "192.0.2.200", true, zone+".", dns.TypeIXFR, before-1000)
+	if len(rrs) < 3 || soaSerial(rrs[1]) != 0 || !hasRR(rrs, "www.example.net. 300 A 192.0.2.80") {
+		t.Errorf("IXFR from an unknown serial did not send the whole zone: %v", rrs)
+	}
+}
+
+func TestXfrSerialsNoCompute(t *testing.T) {
+	initGlobal("t/etc")
+	zone := "child.example.net"
+	xfrZonesLock.Lock()
+	delete(xfrZones, zone) // As if never computed
+	xfrZonesLock.Unlock()
+
+	// The query path does not wait for the zone...
+	soa, err := dns.NewRR("child.example.net. 300 SOA ns1.example.net. hostmaster.example.net. 1 10800 3600 604800 86400")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{soa}
+	xfrSerials(m)
+	if serial := soaSerial(m.Answer[0]); serial != 1 {
+		t.Errorf("SOA of %s has serial %v before its first snapshot, wanted 1", zone, serial)
+	}
+
+	// ...but has taskTransfers compute it, soon.
+	for i := 0; i < 50 && xfrCurrent(zone) == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if snap := xfrCurrent(zone); snap == nil || snap.SOA.Serial == 1 {
+		t.Errorf("%s not computed after xfrSerials: %+v", zone, snap)
+	}
+}